@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"github.com/net-byte/opensocks/client"
+	"github.com/net-byte/opensocks/common/enum"
 	"github.com/net-byte/opensocks/config"
 	"github.com/net-byte/opensocks/counter"
 	"github.com/net-byte/opensocks/server"
@@ -14,7 +15,8 @@ import (
 // Start starts the app by json config
 func Start(jsonConfig string) {
 	CleanCounter()
-	config := config.Config{}
+	// the fec shards missing from the json are the defaults, zero shards disable fec
+	config := config.Config{KCPDataShard: enum.FECData, KCPParityShard: enum.FECParity}
 	err := json.Unmarshal([]byte(jsonConfig), &config)
 	if err != nil {
 		log.Panic("failed to decode config")
@@ -49,6 +51,25 @@ func GetTotalWrittenBytes() string {
 	return strconv.FormatUint(counter.TotalWrittenBytes, 10)
 }
 
+// GetTotalRejectedReplays returns the total rejected replayed handshakes
+func GetTotalRejectedReplays() string {
+	return strconv.FormatUint(counter.TotalRejectedReplays, 10)
+}
+
+// GetUserStats returns the bytes info of each user on server side
+func GetUserStats() string {
+	return counter.PrintUserStats()
+}
+
+// GetSessionState returns the state of the client sessions in json format
+func GetSessionState() string {
+	b, err := json.Marshal(client.SessionState())
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
 // CleanCounter cleans the counter
 func CleanCounter() {
 	counter.Clean()
@@ -4,30 +4,35 @@ import (
 	"context"
 	"log"
 	"net/http"
-	"net/url"
 
 	"github.com/net-byte/opensocks/common/util"
 	"github.com/net-byte/opensocks/config"
 	"github.com/net-byte/opensocks/proxy"
-	p "golang.org/x/net/proxy"
+	"github.com/net-byte/opensocks/transport"
 )
 
 var _tcpServer proxy.TCPServer
 var _udpServer proxy.UDPServer
 var _httpServer http.Server
+var _sessions *proxy.SessionPool
 
 // Start starts the client
 func Start(config config.Config) {
 	util.PrintStats(config.Verbose, config.ServerMode)
+	if err := transport.Check(config); err != nil {
+		log.Panicf("[client] %v", err)
+	}
 	// start http server
 	if config.HttpProxy {
 		go startHttpServer(config)
 	}
+	// the tcp and udp servers share the sessions to the server
+	_sessions = proxy.NewSessionPool(config)
 	// start udp server
-	_udpServer = proxy.UDPServer{Config: config}
+	_udpServer = proxy.UDPServer{Config: config, Pool: _sessions}
 	udpConn := _udpServer.Start()
 	// start tcp server
-	_tcpServer = proxy.TCPServer{Config: config, Tproxy: &proxy.TCPProxy{Config: config}, Uproxy: &proxy.UDPProxy{Config: config}, UDPConn: udpConn}
+	_tcpServer = proxy.TCPServer{Config: config, Tproxy: &proxy.TCPProxy{Config: config, Pool: _sessions}, Uproxy: &proxy.UDPProxy{Config: config, Server: &_udpServer}, UDPConn: udpConn}
 	_tcpServer.Start()
 }
 
@@ -48,21 +53,24 @@ func Stop() {
 			log.Printf("failed to shutdown http server: %v", err)
 		}
 	}
+	if _sessions != nil {
+		_sessions.Close()
+	}
 }
 
-func startHttpServer(config config.Config) {
-	socksURL, err := url.Parse("socks5://" + config.LocalAddr)
-	if err != nil {
-		log.Fatalln("proxy url parse error:", err)
-	}
-	socks5Dialer, err := p.FromURL(socksURL, p.Direct)
-	if err != nil {
-		log.Fatalln("failed to make proxy dialer:", err)
+// SessionState returns the state of the sessions to the server
+func SessionState() []proxy.SessionState {
+	if _sessions == nil {
+		return nil
 	}
+	return _sessions.State()
+}
+
+func startHttpServer(config config.Config) {
 	log.Printf("opensocks [http] client started on %s", config.LocalHttpProxyAddr)
 	_httpServer = http.Server{
 		Addr:    config.LocalHttpProxyAddr,
-		Handler: &proxy.HttpProxyHandler{Dialer: socks5Dialer},
+		Handler: &proxy.HttpProxyHandler{SocksAddr: config.LocalAddr, Accounts: config.LocalAccounts()},
 	}
 	if err := _httpServer.ListenAndServe(); err != nil {
 		log.Printf("failed to start http server:%v", err)
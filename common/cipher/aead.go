@@ -0,0 +1,61 @@
+package cipher
+
+import (
+	stdcipher "crypto/cipher"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The AEAD struct seals and opens frames in order with a counter nonce
+type AEAD struct {
+	aead  stdcipher.AEAD
+	nonce []byte
+}
+
+// NewAEAD creates a ChaCha20-Poly1305 cipher with the key derived from the secret, salt and info
+func NewAEAD(secret []byte, salt []byte, info string) (*AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &AEAD{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+// Overhead returns the size added to each sealed frame
+func (a *AEAD) Overhead() int {
+	return a.aead.Overhead()
+}
+
+// Seal encrypts and authenticates the frame
+func (a *AEAD) Seal(b []byte) []byte {
+	out := a.aead.Seal(nil, a.nonce, b, nil)
+	a.increment()
+	return out
+}
+
+// Open decrypts and authenticates the frame in place
+func (a *AEAD) Open(b []byte) ([]byte, error) {
+	out, err := a.aead.Open(b[:0], a.nonce, b, nil)
+	if err != nil {
+		return nil, err
+	}
+	a.increment()
+	return out, nil
+}
+
+// increment increments the little-endian nonce counter
+func (a *AEAD) increment() {
+	for i := range a.nonce {
+		a.nonce[i]++
+		if a.nonce[i] != 0 {
+			return
+		}
+	}
+}
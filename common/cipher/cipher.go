@@ -1,39 +1,30 @@
 package cipher
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/hex"
-	"math/rand"
-	"strings"
-	"time"
+	"encoding/binary"
+	"math/big"
 )
 
-var _chars = []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
-var _key = []byte("SpUsXuZw4z6B9EbGdKgNjQnTqVsYv2x5")
-
-// Generate key from string
-func GenerateKey(key string) {
-	sha := sha256.Sum256([]byte(key))
-	encode := hex.EncodeToString(sha[:])
-	_key = []byte(encode[0:32])
-}
-
-// XOR encrypt
-func XOR(src []byte) []byte {
-	_klen := len(_key)
-	for i := 0; i < len(src); i++ {
-		src[i] ^= _key[i%_klen]
+// MAC returns the HMAC-SHA256 of the length-prefixed parts
+func MAC(key string, parts ...string) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	var size [4]byte
+	for _, p := range parts {
+		binary.BigEndian.PutUint32(size[:], uint32(len(p)))
+		h.Write(size[:])
+		h.Write([]byte(p))
 	}
-	return src
+	return h.Sum(nil)
 }
 
-// Generate random string
-func Random() string {
-	rand.Seed(time.Now().UnixNano())
-	length := 8 + rand.Intn(8)
-	var b strings.Builder
-	for i := 0; i < length; i++ {
-		b.WriteRune(_chars[rand.Intn(len(_chars))])
+// randInt returns a uniform random int in [0, n)
+func randInt(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
 	}
-	return b.String()
+	return int(v.Int64())
 }
@@ -0,0 +1,136 @@
+package cipher
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/net-byte/opensocks/proto"
+)
+
+const (
+	// maxFrameSize is the max data size of a frame
+	maxFrameSize = 16 * 1024
+	// SaltSize is the size of the salt sent at the start of each native stream
+	SaltSize = 16
+)
+
+// The Conn struct seals the data of the underlying conn with the session keys,
+// each frame holds the data length, the data and the padding
+type Conn struct {
+	net.Conn
+	enc     *AEAD
+	dec     *AEAD
+	pending []byte
+	rlock   sync.Mutex
+	wlock   sync.Mutex
+	padding *padding
+}
+
+// NewConn creates a conn sealed with the keys derived from the session secret, the written frames are padded if enabled
+func NewConn(conn net.Conn, secret []byte, serverSide bool, pad bool) (*Conn, error) {
+	return NewStreamConn(conn, secret, nil, serverSide, pad)
+}
+
+// NewStreamConn creates a conn sealed with the keys derived from the session secret and the salt,
+// each native stream of a session has its own random salt so its keys are not shared with the others
+func NewStreamConn(conn net.Conn, secret []byte, salt []byte, serverSide bool, pad bool) (*Conn, error) {
+	up, err := NewAEAD(secret, salt, "opensocks session upstream")
+	if err != nil {
+		return nil, err
+	}
+	down, err := NewAEAD(secret, salt, "opensocks session downstream")
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{Conn: conn, enc: up, dec: down}
+	if serverSide {
+		c.enc, c.dec = down, up
+	}
+	if pad {
+		c.padding = newPadding()
+		go c.cover()
+	}
+	return c, nil
+}
+
+// Read reads and opens the frames, the padding and the cover frames are dropped
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+	for len(c.pending) == 0 {
+		frame, _, err := proto.Decode(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		plain, err := c.dec.Open(frame)
+		if err != nil {
+			return 0, err
+		}
+		if len(plain) < 2 || int(binary.BigEndian.Uint16(plain)) > len(plain)-2 {
+			return 0, errors.New("invalid frame length")
+		}
+		c.pending = plain[2 : 2+binary.BigEndian.Uint16(plain)]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write seals and writes the frames, the data is buffered toward the target sizes if padded
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if c.padding != nil {
+		return c.writePadded(b)
+	}
+	n := 0
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxFrameSize {
+			size = maxFrameSize
+		}
+		if err := c.writeFrame(b[:size], 0); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// Close flushes the buffered data and closes the conn, it returns the error of the buffered data not written,
+// the conn is closed after a second if a write is stuck on a peer not reading
+func (c *Conn) Close() error {
+	var err error
+	if c.padding != nil {
+		c.padding.stop()
+		timer := time.AfterFunc(time.Second, func() { c.Conn.Close() })
+		c.wlock.Lock()
+		if c.padding.err == nil && len(c.padding.buf) > 0 {
+			c.flushPadded()
+		}
+		err = c.padding.err
+		c.wlock.Unlock()
+		timer.Stop()
+	}
+	if cerr := c.Conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeFrame seals and writes the data followed by the padding size of zeros
+func (c *Conn) writeFrame(data []byte, pad int) error {
+	plain := make([]byte, 2+len(data)+pad)
+	binary.BigEndian.PutUint16(plain, uint16(len(data)))
+	copy(plain[2:], data)
+	frame, err := proto.Encode(c.enc.Seal(plain))
+	if err != nil {
+		return err
+	}
+	_, err = c.Conn.Write(frame)
+	return err
+}
@@ -0,0 +1,32 @@
+package cipher
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// GenerateKeyPair generates an ephemeral X25519 key pair
+func GenerateKeyPair() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// SessionSecret derives the session secret from the X25519 exchange and the transcript
+func SessionSecret(priv *ecdh.PrivateKey, peer []byte, transcript []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, transcript, []byte("opensocks session")), secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
@@ -0,0 +1,105 @@
+package cipher
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// minPadSize and maxPadSize bound the data and padding size of the padded frames
+	minPadSize = 256
+	maxPadSize = 2048
+	// coalesceDelay is the max delay of the buffered data
+	coalesceDelay = 5 * time.Millisecond
+	// coverIdle is the idle time before sending the cover frames
+	coverIdle = time.Second
+)
+
+// The padding struct buffers the written data toward random frame sizes
+type padding struct {
+	buf    []byte
+	target int
+	last   time.Time
+	timer  *time.Timer
+	err    error
+	die    chan struct{}
+	once   sync.Once
+}
+
+func newPadding() *padding {
+	return &padding{target: padSize(), last: time.Now(), die: make(chan struct{})}
+}
+
+// stop stops the cover frames, the pending flush timer finds the data already flushed by Close
+func (p *padding) stop() {
+	p.once.Do(func() {
+		close(p.die)
+	})
+}
+
+// padSize returns a random frame size
+func padSize() int {
+	return minPadSize + randInt(maxPadSize-minPadSize+1)
+}
+
+// writePadded splits the buffered data into full frames and delays the rest to be coalesced,
+// the error of a delayed flush is returned by the next write or by Close
+func (c *Conn) writePadded(b []byte) (int, error) {
+	p := c.padding
+	if p.err != nil {
+		return 0, p.err
+	}
+	buffered := len(p.buf)
+	p.buf = append(p.buf, b...)
+	p.last = time.Now()
+	off := 0
+	for len(p.buf)-off >= p.target {
+		if p.err = c.writeFrame(p.buf[off:off+p.target], 0); p.err != nil {
+			// the bytes of b in the frames written before
+			return max(off-buffered, 0), p.err
+		}
+		off += p.target
+		p.target = padSize()
+	}
+	p.buf = append(p.buf[:0], p.buf[off:]...)
+	if len(p.buf) > 0 && p.timer == nil {
+		p.timer = time.AfterFunc(coalesceDelay, func() {
+			c.wlock.Lock()
+			defer c.wlock.Unlock()
+			p.timer = nil
+			if p.err == nil && len(p.buf) > 0 {
+				c.flushPadded()
+			}
+		})
+	}
+	return len(b), nil
+}
+
+// flushPadded writes the buffered data padded to the target size
+func (c *Conn) flushPadded() {
+	p := c.padding
+	p.err = c.writeFrame(p.buf, p.target-len(p.buf))
+	p.buf = p.buf[:0]
+	p.target = padSize()
+}
+
+// cover sends the cover frames while the conn is idle
+func (c *Conn) cover() {
+	p := c.padding
+	for {
+		select {
+		case <-p.die:
+			return
+		case <-time.After(coverIdle + time.Duration(randInt(int(coverIdle/time.Millisecond)*3))*time.Millisecond):
+		}
+		c.wlock.Lock()
+		if p.err == nil && time.Since(p.last) >= coverIdle {
+			p.err = c.writeFrame(nil, padSize())
+		}
+		err := p.err
+		c.wlock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package cipher
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The failing conn struct accepts the given number of writes and fails the next ones
+type failingConn struct {
+	net.Conn
+	lock   sync.Mutex
+	writes int
+	closed bool
+}
+
+var errWrite = errors.New("write failed")
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.writes == 0 {
+		return 0, errWrite
+	}
+	c.writes--
+	return len(b), nil
+}
+
+func (c *failingConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *failingConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func newPaddedConn(t *testing.T, writes int) (*Conn, *failingConn) {
+	t.Helper()
+	fc := &failingConn{writes: writes}
+	c, err := NewConn(fc, make([]byte, 32), false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, fc
+}
+
+func TestWritePaddedPartial(t *testing.T) {
+	c, _ := newPaddedConn(t, 1)
+	c.wlock.Lock()
+	target := c.padding.target
+	c.wlock.Unlock()
+	// the first frame is written and the second fails
+	b := make([]byte, 3*maxPadSize)
+	n, err := c.Write(b)
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("got %v, want the write error", err)
+	}
+	if n != target {
+		t.Fatalf("got %d bytes written, want %d", n, target)
+	}
+	if n, err = c.Write(b); n != 0 || !errors.Is(err, errWrite) {
+		t.Fatalf("got %d %v after the failure, want the write error", n, err)
+	}
+}
+
+func TestWritePaddedBuffered(t *testing.T) {
+	c, _ := newPaddedConn(t, 1)
+	// the first write is buffered and committed by the first frame
+	first := make([]byte, minPadSize/2)
+	if n, err := c.Write(first); n != len(first) || err != nil {
+		t.Fatalf("got %d %v, want the data buffered", n, err)
+	}
+	// the second frame fails, only the part of b in the first frame is written
+	c.wlock.Lock()
+	target := c.padding.target
+	c.wlock.Unlock()
+	n, err := c.Write(make([]byte, 2*maxPadSize+minPadSize))
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("got %v, want the write error", err)
+	}
+	if n != target-len(first) {
+		t.Fatalf("got %d bytes written, want %d", n, target-len(first))
+	}
+}
+
+func TestDelayedFlushError(t *testing.T) {
+	c, fc := newPaddedConn(t, 0)
+	if n, err := c.Write([]byte("buffered")); n != 8 || err != nil {
+		t.Fatalf("got %d %v, want the data buffered", n, err)
+	}
+	time.Sleep(10 * coalesceDelay)
+	if _, err := c.Write([]byte("next")); !errors.Is(err, errWrite) {
+		t.Fatalf("got %v, want the error of the delayed flush", err)
+	}
+	if err := c.Close(); !errors.Is(err, errWrite) {
+		t.Fatalf("got %v, want the error of the delayed flush", err)
+	}
+	if !fc.closed {
+		t.Fatal("conn not closed")
+	}
+}
+
+func TestCloseFlushError(t *testing.T) {
+	c, _ := newPaddedConn(t, 0)
+	c.wlock.Lock()
+	c.padding.buf = append(c.padding.buf, "buffered"...)
+	c.wlock.Unlock()
+	if err := c.Close(); !errors.Is(err, errWrite) {
+		t.Fatalf("got %v, want the error of the flush", err)
+	}
+}
+
+func TestCloseStuckWrite(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	c, err := NewConn(conn, make([]byte, 32), false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer never reads, so the write of a full frame is stuck
+	go c.Write(make([]byte, 3*maxPadSize))
+	time.Sleep(50 * time.Millisecond)
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("close blocked by the stuck write")
+	}
+}
@@ -38,10 +38,22 @@ const (
 	Timeout    int    = 60
 	BufferSize int    = 64 * 1024
 	WSPath     string = "/freedom"
+	QUICProto  string = "opensocks"
+	H2Path     string = "/grpc.Tunnel/Stream"
+	KCPMode    string = "default"
+	KCPMTU     int    = 1400
+	KCPCrypt   string = "aes"
+	KCPSalt    string = "opensocks@2022"
 	SndWnd     int    = 10240
 	RcvWnd     int    = 10240
+	FECData    int    = 10
+	FECParity  int    = 3
 	SockBuf    int    = 4194304
 	SmuxVer    int    = 2
+	KeepAlive  int    = 10
 	SmuxBuf    int    = 4194304
 	StreamBuf  int    = 2097152
+	ReplaySize int    = 100000
+	ProbeLimit int    = 16
+	ProbeTime  int    = 600
 )
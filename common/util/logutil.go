@@ -12,7 +12,7 @@ func PrintLog(enableVerbose bool, format string, v ...any) {
 	if !enableVerbose {
 		return
 	}
-	log.Printf("[info] "+format, v)
+	log.Printf("[info] "+format, v...)
 }
 
 // PrintStats returns the stats info
@@ -24,7 +24,10 @@ func PrintStats(enableVerbose bool, serverMode bool) {
 		for {
 			time.Sleep(30 * time.Second)
 			if serverMode {
-				log.Printf("stats:%v", counter.PrintServerBytes())
+				log.Printf("stats:%v", counter.PrintServerStats())
+				if users := counter.PrintUserStats(); users != "" {
+					log.Printf("user stats:\n%v", users)
+				}
 			} else {
 				log.Printf("stats:%v", counter.PrintClientBytes())
 			}
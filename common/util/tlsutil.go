@@ -0,0 +1,180 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/net-byte/opensocks/config"
+)
+
+// NewServerTLSConfig returns the server tls config with the cert files or a self-signed certificate
+func NewServerTLSConfig(config config.Config) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if config.TLSCert != "" && config.TLSKey != "" {
+		cert, err = tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	} else if config.TLSSelfSigned {
+		cert, err = generateCertificate(config.ServerAddr)
+	} else {
+		err = errors.New("no certificate, set -tls-cert and -tls-key or -tls-self-signed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if config.TLSClientCA != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(config.TLSClientCA); err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// NewClientTLSConfig returns the client tls config with the ca bundle, public key pin and sni
+func NewClientTLSConfig(config config.Config) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(config.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12, InsecureSkipVerify: config.TLSInsecure}
+	if config.TLSServerName != "" {
+		tlsConfig.ServerName = config.TLSServerName
+	}
+	if config.TLSCA != "" {
+		if tlsConfig.RootCAs, err = loadCertPool(config.TLSCA); err != nil {
+			return nil, err
+		}
+	}
+	if config.TLSClientCert != "" && config.TLSClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSClientCert, config.TLSClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.TLSPin == "" {
+		return tlsConfig, nil
+	}
+	// the pin replaces the chain verification unless a ca bundle is set
+	pin := strings.TrimPrefix(strings.TrimPrefix(config.TLSPin, "sha256//"), "sha256/")
+	verifyChain := config.TLSCA != "" && !config.TLSInsecure
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no server certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		if got := PublicKeyPin(leaf); got != pin {
+			log.Printf("[client] server certificate pin mismatch, expected sha256/%s got sha256/%s", pin, got)
+			return errors.New("server certificate pin mismatch")
+		}
+		if !verifyChain {
+			return nil
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, DNSName: tlsConfig.ServerName, Intermediates: intermediates})
+		return err
+	}
+	return tlsConfig, nil
+}
+
+// PeerIdentity returns the subject of the client certificate if the conn has a tls state
+func PeerIdentity(conn net.Conn) (string, error) {
+	if stateConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			if err := tlsConn.Handshake(); err != nil {
+				return "", err
+			}
+		}
+		return StateIdentity(stateConn.ConnectionState()), nil
+	}
+	return "", nil
+}
+
+// StateIdentity returns the common name or the subject of the client certificate of the tls state
+func StateIdentity(state tls.ConnectionState) string {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	if certs[0].Subject.CommonName != "" {
+		return certs[0].Subject.CommonName
+	}
+	return certs[0].Subject.String()
+}
+
+// PublicKeyPin returns the base64 encoded sha256 of the certificate public key
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// loadCertPool loads the pem certificates from the file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// generateCertificate generates a self-signed certificate for the address
+func generateCertificate(addr string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "opensocks"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("generated self-signed certificate, public key pin sha256/%s", PublicKeyPin(cert))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, nil
+}
@@ -1,7 +1,13 @@
 package config
 
 import (
-	"github.com/net-byte/opensocks/common/cipher"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
 )
 
 // The config struct
@@ -17,8 +23,181 @@ type Config struct {
 	Compress           bool
 	HttpProxy          bool
 	Verbose            bool
+	Skew               int
+	UsersFile          string
+	Users              []User
+	LocalAuth          string
+	TLSCert            string
+	TLSKey             string
+	TLSSelfSigned      bool
+	TLSCA              string
+	TLSPin             string
+	TLSServerName      string
+	TLSInsecure        bool
+	TLSClientCA        string
+	TLSClientCert      string
+	TLSClientKey       string
+	ACLFile            string
+	ACL                ACL
+	Fallback           string
+	WSPath             string
+	WSHost             string
+	WSHeaders          string
+	WSConnect          string
+	WSSecret           string
+	Padding            bool
+	Optimistic         bool
+	H2Path             string
+	KCPMode            string
+	KCPNoDelay         int
+	KCPInterval        int
+	KCPResend          int
+	KCPNoCongestion    int
+	KCPMTU             int
+	KCPSndWnd          int
+	KCPRcvWnd          int
+	KCPDataShard       int
+	KCPParityShard     int
+	KCPDSCP            int
+	KCPCrypt           string
+	KCPSalt            string
+	PoolSize           int
+	KeepAlive          int
+	KeepAliveTimeout   int
+}
+
+// The user struct
+type User struct {
+	Name    string
+	Key     string
+	Enabled bool
+	Expiry  time.Time
+}
+
+// The ACL struct is the destination policy of the server
+type ACL struct {
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+	AllowPorts   []string
+	DenyPorts    []string
+	AllowDomains []string
+	DenyDomains  []string
+	AllowPrivate bool
+}
+
+// Valid returns true if the user is enabled and not expired
+func (u User) Valid(now time.Time) bool {
+	return u.Enabled && (u.Expiry.IsZero() || now.Before(u.Expiry))
 }
 
 func (config *Config) Init() {
-	cipher.GenerateKey(config.Key)
+	if config.Protocol == "" {
+		config.Protocol = "ws"
+	}
+	if config.KCPMode == "" {
+		config.KCPMode = enum.KCPMode
+	}
+	if config.KCPCrypt == "" {
+		config.KCPCrypt = enum.KCPCrypt
+	}
+	if config.KCPSalt == "" {
+		config.KCPSalt = enum.KCPSalt
+	}
+	if config.KCPMTU <= 0 {
+		config.KCPMTU = enum.KCPMTU
+	}
+	if config.KCPSndWnd <= 0 {
+		config.KCPSndWnd = enum.SndWnd
+	}
+	if config.KCPRcvWnd <= 0 {
+		config.KCPRcvWnd = enum.RcvWnd
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = 1
+	}
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = enum.KeepAlive
+	}
+	if config.KeepAliveTimeout < config.KeepAlive {
+		config.KeepAliveTimeout = 3 * config.KeepAlive
+	}
+	if config.Skew <= 0 {
+		config.Skew = enum.Timeout
+	}
+	if config.H2Path == "" {
+		config.H2Path = enum.H2Path
+	} else if !strings.HasPrefix(config.H2Path, "/") {
+		config.H2Path = "/" + config.H2Path
+	}
+	if config.WSPath == "" {
+		config.WSPath = enum.WSPath
+	} else if !strings.HasPrefix(config.WSPath, "/") {
+		config.WSPath = "/" + config.WSPath
+	}
+}
+
+// ServerTLS returns true if the server has a certificate to serve tls
+func (config *Config) ServerTLS() bool {
+	return (config.TLSCert != "" && config.TLSKey != "") || config.TLSSelfSigned
+}
+
+// LoadUsers returns the users of the config and the users file, or the default user with the key
+func (config *Config) LoadUsers() ([]User, error) {
+	users := append([]User{}, config.Users...)
+	if config.UsersFile != "" {
+		b, err := os.ReadFile(config.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		var fileUsers []User
+		if err = json.Unmarshal(b, &fileUsers); err != nil {
+			return nil, err
+		}
+		users = append(users, fileUsers...)
+	}
+	if config.UsersFile == "" && len(users) == 0 {
+		users = append(users, User{Name: "default", Key: config.Key, Enabled: true})
+	}
+	return users, nil
+}
+
+// LocalAccounts returns the username and password pairs of the local proxies
+func (config *Config) LocalAccounts() map[string]string {
+	accounts := make(map[string]string)
+	for _, pair := range strings.Split(config.LocalAuth, ",") {
+		username, password, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && username != "" {
+			accounts[username] = password
+		}
+	}
+	return accounts
+}
+
+// WSRequestHeader returns the extra headers of the websocket requests, including the secret
+func (config *Config) WSRequestHeader() http.Header {
+	header := make(http.Header)
+	for _, pair := range strings.Split(config.WSHeaders, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && strings.TrimSpace(name) != "" {
+			header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+	if config.WSSecret != "" {
+		header.Set("Authorization", "Bearer "+config.WSSecret)
+	}
+	return header
+}
+
+// LoadACL returns the destination policy of the config or the acl file
+func (config *Config) LoadACL() (ACL, error) {
+	if config.ACLFile == "" {
+		return config.ACL, nil
+	}
+	var acl ACL
+	b, err := os.ReadFile(config.ACLFile)
+	if err != nil {
+		return acl, err
+	}
+	err = json.Unmarshal(b, &acl)
+	return acl, err
 }
@@ -2,6 +2,9 @@ package counter
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/inhies/go-bytesize"
@@ -13,6 +16,17 @@ var TotalReadBytes uint64 = 0
 // TotalWrittenBytes is the total number of bytes written
 var TotalWrittenBytes uint64 = 0
 
+// TotalRejectedReplays is the total number of rejected replayed handshakes
+var TotalRejectedReplays uint64 = 0
+
+// The user bytes struct
+type userBytes struct {
+	read    uint64
+	written uint64
+}
+
+var _userBytes sync.Map
+
 // IncrReadBytes increments the number of bytes read
 func IncrReadBytes(n int) {
 	atomic.AddUint64(&TotalReadBytes, uint64(n))
@@ -23,6 +37,28 @@ func IncrWrittenBytes(n int) {
 	atomic.AddUint64(&TotalWrittenBytes, uint64(n))
 }
 
+// IncrRejectedReplays increments the number of rejected replayed handshakes
+func IncrRejectedReplays() {
+	atomic.AddUint64(&TotalRejectedReplays, 1)
+}
+
+// IncrUserReadBytes increments the number of bytes read by the user
+func IncrUserReadBytes(user string, n int) {
+	IncrReadBytes(n)
+	atomic.AddUint64(&loadUserBytes(user).read, uint64(n))
+}
+
+// IncrUserWrittenBytes increments the number of bytes written to the user
+func IncrUserWrittenBytes(user string, n int) {
+	IncrWrittenBytes(n)
+	atomic.AddUint64(&loadUserBytes(user).written, uint64(n))
+}
+
+func loadUserBytes(user string) *userBytes {
+	v, _ := _userBytes.LoadOrStore(user, &userBytes{})
+	return v.(*userBytes)
+}
+
 // PrintClientBytes returns the bytes info on client side
 func PrintClientBytes() string {
 	return fmt.Sprintf("download %v upload %v", bytesize.New(float64(TotalReadBytes)).String(), bytesize.New(float64(TotalWrittenBytes)).String())
@@ -33,8 +69,30 @@ func PrintServerBytes() string {
 	return fmt.Sprintf("download %v upload %v", bytesize.New(float64(TotalWrittenBytes)).String(), bytesize.New(float64(TotalReadBytes)).String())
 }
 
+// PrintServerStats returns the stats info on server side
+func PrintServerStats() string {
+	return fmt.Sprintf("%v replays %v", PrintServerBytes(), atomic.LoadUint64(&TotalRejectedReplays))
+}
+
+// PrintUserStats returns the bytes info of each user on server side
+func PrintUserStats() string {
+	var stats []string
+	_userBytes.Range(func(key, value any) bool {
+		b := value.(*userBytes)
+		stats = append(stats, fmt.Sprintf("%v download %v upload %v", key, bytesize.New(float64(atomic.LoadUint64(&b.written))).String(), bytesize.New(float64(atomic.LoadUint64(&b.read))).String()))
+		return true
+	})
+	sort.Strings(stats)
+	return strings.Join(stats, "\n")
+}
+
 // Clean clean the counter
 func Clean() {
 	TotalReadBytes = 0
 	TotalWrittenBytes = 0
+	TotalRejectedReplays = 0
+	_userBytes.Range(func(key, value any) bool {
+		_userBytes.Delete(key)
+		return true
+	})
 }
@@ -1,6 +1,6 @@
 module github.com/net-byte/opensocks
 
-go 1.20
+go 1.24
 
 require (
 	github.com/gobwas/ws v1.1.0
@@ -10,10 +10,11 @@ require (
 require (
 	github.com/golang/snappy v0.0.4
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
+	github.com/quic-go/quic-go v0.59.1
 	github.com/xtaci/kcp-go/v5 v5.6.1
 	github.com/xtaci/smux v1.5.24
-	golang.org/x/crypto v0.4.0
-	golang.org/x/net v0.3.0
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.43.0
 )
 
 require (
@@ -26,8 +27,8 @@ require (
 	github.com/templexxx/cpu v0.0.7 // indirect
 	github.com/templexxx/xorsimd v0.4.1 // indirect
 	github.com/tjfoc/gmsm v1.3.2 // indirect
-	golang.org/x/mod v0.4.2 // indirect
-	golang.org/x/sys v0.3.0 // indirect
-	golang.org/x/tools v0.1.8-0.20211022200916-316ba0b74098 // indirect
+	golang.org/x/mod v0.27.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/tools v0.36.0 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 )
@@ -5,6 +5,7 @@ import (
 	"log"
 
 	"github.com/net-byte/opensocks/client"
+	"github.com/net-byte/opensocks/common/enum"
 	"github.com/net-byte/opensocks/config"
 	"github.com/net-byte/opensocks/server"
 )
@@ -26,14 +27,62 @@ func main() {
 	flag.StringVar(&config.ServerAddr, "s", ":8081", "server address")
 	flag.StringVar(&config.Key, "k", "6w9z$C&F)J@NcRfUjXn2r4u7x!A%D*G-", "encryption key")
 	flag.BoolVar(&config.ServerMode, "S", false, "server mode")
-	flag.StringVar(&config.Protocol, "p", "wss", "protocol ws/wss/kcp/tcp")
+	flag.StringVar(&config.Protocol, "p", "wss", "protocol ws/wss/kcp/tcp/tls/quic/h2/h2c")
 	flag.BoolVar(&config.Bypass, "bypass", false, "bypass private ip")
-	flag.BoolVar(&config.Obfs, "obfs", false, "enable data obfuscation")
+	flag.BoolVar(&config.Obfs, "obfs", false, "enable data obfuscation and encryption")
 	flag.BoolVar(&config.Compress, "compress", false, "enable data compression")
+	flag.BoolVar(&config.Padding, "padding", false, "enable traffic padding and cover frames")
+	flag.BoolVar(&config.Optimistic, "optimistic", false, "client replies socks5 at once and sends the first payload with the handshake")
+	flag.IntVar(&config.PoolSize, "pool", 1, "client session pool size, the streams go to the least loaded session")
+	flag.IntVar(&config.KeepAlive, "keepalive", enum.KeepAlive, "keepalive and ping interval in seconds of the sessions")
+	flag.IntVar(&config.KeepAliveTimeout, "keepalive-timeout", 3*enum.KeepAlive, "seconds without reply after which a session is dead")
 	flag.BoolVar(&config.HttpProxy, "http-proxy", false, "enable http proxy")
 	flag.BoolVar(&config.Verbose, "v", false, "enable verbose output")
+	flag.StringVar(&config.LocalAuth, "auth", "", "local socks5 and http proxy accounts in user:pass format, separated by comma")
+	flag.StringVar(&config.UsersFile, "users", "", "server users file in json format")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "server tls certificate file")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "server tls key file")
+	flag.BoolVar(&config.TLSSelfSigned, "tls-self-signed", false, "generate a self-signed server certificate on startup")
+	flag.StringVar(&config.TLSCA, "tls-ca", "", "client ca bundle file to verify the server certificate")
+	flag.StringVar(&config.TLSPin, "tls-pin", "", "client sha256 pin of the server public key in base64")
+	flag.StringVar(&config.TLSServerName, "tls-sni", "", "client tls server name override")
+	flag.BoolVar(&config.TLSInsecure, "tls-insecure", false, "client skips the server certificate verification")
+	flag.StringVar(&config.TLSClientCA, "tls-client-ca", "", "server ca bundle file to require and verify client certificates")
+	flag.StringVar(&config.TLSClientCert, "tls-client-cert", "", "client tls certificate file")
+	flag.StringVar(&config.TLSClientKey, "tls-client-key", "", "client tls key file")
+	flag.StringVar(&config.ACLFile, "acl", "", "server destination policy file in json format")
+	flag.StringVar(&config.Fallback, "fallback", "", "server fallback address for the tcp/tls connections failing the handshake")
+	flag.StringVar(&config.WSPath, "ws-path", enum.WSPath, "websocket path")
+	flag.StringVar(&config.H2Path, "h2-path", enum.H2Path, "h2 and h2c request path")
+	flag.StringVar(&config.WSHost, "ws-host", "", "client websocket host header override")
+	flag.StringVar(&config.WSHeaders, "ws-headers", "", "client websocket request headers in name:value format, separated by comma")
+	flag.StringVar(&config.WSConnect, "ws-connect", "", "client websocket connect address, the server address by default")
+	flag.StringVar(&config.WSSecret, "ws-secret", "", "websocket secret sent by the client and required by the server")
+	flag.StringVar(&config.KCPMode, "kcp-mode", enum.KCPMode, "kcp mode default/normal/fast/fast2/fast3/manual")
+	flag.IntVar(&config.KCPNoDelay, "kcp-nodelay", 0, "kcp nodelay in manual mode")
+	flag.IntVar(&config.KCPInterval, "kcp-interval", 50, "kcp update interval in milliseconds in manual mode")
+	flag.IntVar(&config.KCPResend, "kcp-resend", 0, "kcp fast resend in manual mode")
+	flag.IntVar(&config.KCPNoCongestion, "kcp-nc", 0, "kcp disables the congestion control in manual mode")
+	flag.IntVar(&config.KCPMTU, "kcp-mtu", enum.KCPMTU, "kcp mtu")
+	flag.IntVar(&config.KCPSndWnd, "kcp-sndwnd", enum.SndWnd, "kcp send window size in packets")
+	flag.IntVar(&config.KCPRcvWnd, "kcp-rcvwnd", enum.RcvWnd, "kcp receive window size in packets")
+	flag.IntVar(&config.KCPDataShard, "kcp-datashard", enum.FECData, "kcp fec data shards, must match on the client and the server")
+	flag.IntVar(&config.KCPParityShard, "kcp-parityshard", enum.FECParity, "kcp fec parity shards, 0 disables fec, must match on the client and the server")
+	flag.IntVar(&config.KCPDSCP, "kcp-dscp", 0, "kcp dscp of the udp packets")
+	flag.StringVar(&config.KCPCrypt, "kcp-crypt", enum.KCPCrypt, "kcp packet cipher aes/aes-128/aes-192/salsa20/sm4/xtea/tea/blowfish/twofish/cast5/3des/xor/none, must match on the client and the server")
+	flag.StringVar(&config.KCPSalt, "kcp-salt", enum.KCPSalt, "kcp key derivation salt, must match on the client and the server")
+	flag.IntVar(&config.Skew, "skew", 60, "max clock skew in seconds allowed for handshakes")
 	flag.Parse()
 	log.Println(_banner)
+	// the mode presets override the manual tuning
+	if config.KCPMode != "manual" {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "kcp-nodelay", "kcp-interval", "kcp-resend", "kcp-nc":
+				log.Printf("warning: -%s is ignored by the kcp mode %s, set -kcp-mode manual to use it", f.Name, config.KCPMode)
+			}
+		})
+	}
 	config.Init()
 	if config.ServerMode {
 		server.Start(config)
@@ -0,0 +1,87 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// KeySize is the size of the X25519 public key
+	KeySize = 32
+	// NonceSize is the size of the hello nonce
+	NonceSize = 16
+	// MACSize is the size of the HMAC-SHA256
+	MACSize = 32
+	// HelloSize is the size of the hello message
+	HelloSize = KeySize + 8 + NonceSize + MACSize
+	// HelloReplySize is the size of the hello reply message
+	HelloReplySize = KeySize + MACSize
+)
+
+// The Hello struct is the first message of the session key exchange
+type Hello struct {
+	PublicKey []byte
+	Timestamp int64
+	Nonce     []byte
+	MAC       []byte
+}
+
+// MarshalBinary marshals the Hello
+func (h *Hello) MarshalBinary() ([]byte, error) {
+	if len(h.PublicKey) != KeySize || len(h.Nonce) != NonceSize || len(h.MAC) != MACSize {
+		return nil, errors.New("invalid hello")
+	}
+	b := make([]byte, 0, HelloSize)
+	b = append(b, h.PublicKey...)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.Timestamp))
+	b = append(b, h.Nonce...)
+	return append(b, h.MAC...), nil
+}
+
+// UnmarshalBinary unmarshals the Hello
+func (h *Hello) UnmarshalBinary(b []byte) error {
+	if len(b) != HelloSize {
+		return errors.New("invalid hello")
+	}
+	h.PublicKey = b[:KeySize]
+	h.Timestamp = int64(binary.BigEndian.Uint64(b[KeySize:]))
+	h.Nonce = b[KeySize+8 : KeySize+8+NonceSize]
+	h.MAC = b[KeySize+8+NonceSize:]
+	return nil
+}
+
+// Signed returns the signed part of the Hello
+func (h *Hello) Signed() []string {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(h.Timestamp))
+	return []string{"hello", string(h.PublicKey), string(ts[:]), string(h.Nonce)}
+}
+
+// The HelloReply struct is the server message of the session key exchange
+type HelloReply struct {
+	PublicKey []byte
+	MAC       []byte
+}
+
+// MarshalBinary marshals the HelloReply
+func (r *HelloReply) MarshalBinary() ([]byte, error) {
+	if len(r.PublicKey) != KeySize || len(r.MAC) != MACSize {
+		return nil, errors.New("invalid hello reply")
+	}
+	return append(append([]byte{}, r.PublicKey...), r.MAC...), nil
+}
+
+// UnmarshalBinary unmarshals the HelloReply
+func (r *HelloReply) UnmarshalBinary(b []byte) error {
+	if len(b) != HelloReplySize {
+		return errors.New("invalid hello reply")
+	}
+	r.PublicKey = b[:KeySize]
+	r.MAC = b[KeySize:]
+	return nil
+}
+
+// Signed returns the signed part of the HelloReply bound to the hello
+func (r *HelloReply) Signed(hello []byte) []string {
+	return []string{"hello reply", string(hello), string(r.PublicKey)}
+}
@@ -0,0 +1,105 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testHello() Hello {
+	return Hello{
+		PublicKey: bytes.Repeat([]byte{1}, KeySize),
+		Timestamp: 1700000000,
+		Nonce:     bytes.Repeat([]byte{2}, NonceSize),
+		MAC:       bytes.Repeat([]byte{3}, MACSize),
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	hello := testHello()
+	b, err := hello.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != HelloSize {
+		t.Fatalf("got %d bytes, want %d", len(b), HelloSize)
+	}
+	var got Hello
+	if err = got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.PublicKey, hello.PublicKey) || got.Timestamp != hello.Timestamp ||
+		!bytes.Equal(got.Nonce, hello.Nonce) || !bytes.Equal(got.MAC, hello.MAC) {
+		t.Fatalf("got %+v, want %+v", got, hello)
+	}
+}
+
+func TestHelloTruncated(t *testing.T) {
+	hello := testHello()
+	b, err := hello.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"public key", KeySize / 2},
+		{"timestamp", KeySize + 4},
+		{"nonce", KeySize + 8 + NonceSize/2},
+		{"mac", KeySize + 8 + NonceSize + MACSize/2},
+		{"last byte", HelloSize - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Hello
+			if err := got.UnmarshalBinary(b[:tt.size]); err == nil {
+				t.Fatalf("truncated to %d bytes accepted", tt.size)
+			}
+		})
+	}
+	var got Hello
+	if err = got.UnmarshalBinary(append(b, 0)); err == nil {
+		t.Fatal("trailing byte accepted")
+	}
+}
+
+func TestHelloMarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*Hello)
+	}{
+		{"short public key", func(h *Hello) { h.PublicKey = h.PublicKey[1:] }},
+		{"long nonce", func(h *Hello) { h.Nonce = append(h.Nonce, 0) }},
+		{"no mac", func(h *Hello) { h.MAC = nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := testHello()
+			tt.mutate(&hello)
+			if _, err := hello.MarshalBinary(); err == nil {
+				t.Fatal("invalid hello marshaled")
+			}
+		})
+	}
+}
+
+func TestHelloReplyRoundTrip(t *testing.T) {
+	reply := HelloReply{PublicKey: bytes.Repeat([]byte{4}, KeySize), MAC: bytes.Repeat([]byte{5}, MACSize)}
+	b, err := reply.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got HelloReply
+	if err = got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.PublicKey, reply.PublicKey) || !bytes.Equal(got.MAC, reply.MAC) {
+		t.Fatalf("got %+v, want %+v", got, reply)
+	}
+	for size := range len(b) {
+		if err = got.UnmarshalBinary(b[:size]); err == nil {
+			t.Fatalf("truncated to %d bytes accepted", size)
+		}
+	}
+}
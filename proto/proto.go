@@ -1,11 +1,15 @@
 package proto
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 )
 
+// MaxSize is the max size of a decoded package
+const MaxSize = 1 << 20
+
 // Encode encodes a byte array into a byte array
 func Encode(data []byte) ([]byte, error) {
 	length := int32(len(data))
@@ -21,22 +25,20 @@ func Encode(data []byte) ([]byte, error) {
 	return pkg.Bytes(), nil
 }
 
-// Decode decodes a byte array into a byte array
-func Decode(reader *bufio.Reader) ([]byte, int32, error) {
-	len, _ := reader.Peek(4)
-	blen := bytes.NewBuffer(len)
+// Decode decodes a byte array from the reader
+func Decode(reader io.Reader) ([]byte, int32, error) {
 	var dlen int32
-	err := binary.Read(blen, binary.LittleEndian, &dlen)
+	err := binary.Read(reader, binary.LittleEndian, &dlen)
 	if err != nil {
 		return nil, 0, err
 	}
-	if int32(reader.Buffered()) < dlen+4 {
-		return nil, 0, err
+	if dlen < 0 || dlen > MaxSize {
+		return nil, 0, errors.New("invalid package length")
 	}
-	pack := make([]byte, 4+dlen)
-	_, err = reader.Read(pack)
+	pack := make([]byte, dlen)
+	_, err = io.ReadFull(reader, pack)
 	if err != nil {
 		return nil, 0, err
 	}
-	return pack[4:], dlen, nil
+	return pack, dlen, nil
 }
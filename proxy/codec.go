@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/net-byte/opensocks/common/cipher"
+	"github.com/net-byte/opensocks/proto"
+)
+
+// ErrInvalidFrame is returned when a frame fails the authentication
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// The Codec struct encodes and decodes the data of a stream
+type Codec struct {
+	compress bool
+	enc      *cipher.AEAD
+	dec      *cipher.AEAD
+}
+
+// NewCodec creates the codec of the stream with the agreed flags, the keys are derived from the session secret and the request
+func NewCodec(flags uint8, secret []byte, req RequestAddr, serverSide bool) (*Codec, error) {
+	c := &Codec{compress: flags&FlagCompress != 0}
+	if flags&FlagObfs == 0 {
+		return c, nil
+	}
+	salt := binary.BigEndian.AppendUint64(nil, uint64(req.Timestamp))
+	salt = append(salt, req.Random...)
+	up, err := cipher.NewAEAD(secret, salt, "opensocks upstream")
+	if err != nil {
+		return nil, err
+	}
+	down, err := cipher.NewAEAD(secret, salt, "opensocks downstream")
+	if err != nil {
+		return nil, err
+	}
+	if serverSide {
+		c.enc, c.dec = down, up
+	} else {
+		c.enc, c.dec = up, down
+	}
+	return c, nil
+}
+
+// Encode encodes the data to be written to the stream
+func (c *Codec) Encode(b []byte) ([]byte, error) {
+	if c.compress {
+		b = snappy.Encode(nil, b)
+	}
+	if c.enc == nil {
+		return b, nil
+	}
+	return proto.Encode(c.enc.Seal(b))
+}
+
+// Decode reads and decodes the data from the stream
+func (c *Codec) Decode(reader io.Reader, buffer []byte) ([]byte, error) {
+	var b []byte
+	if c.enc == nil {
+		// the data read along with an error is returned first
+		n, err := reader.Read(buffer)
+		if n == 0 && err != nil {
+			return nil, err
+		}
+		b = buffer[:n]
+	} else {
+		frame, _, err := proto.Decode(reader)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = c.dec.Open(frame); err != nil {
+			return nil, ErrInvalidFrame
+		}
+	}
+	if c.compress {
+		return snappy.Decode(nil, b)
+	}
+	return b, nil
+}
@@ -1,88 +1,91 @@
 package proxy
 
 import (
-	"context"
-	"crypto/sha1"
+	"crypto/rand"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"strconv"
 	"time"
 
-	"github.com/gobwas/ws"
-	"github.com/net-byte/opensocks/common/cipher"
 	"github.com/net-byte/opensocks/common/enum"
 	"github.com/net-byte/opensocks/config"
 	"github.com/net-byte/opensocks/proto"
-	"github.com/xtaci/kcp-go/v5"
-	"golang.org/x/crypto/pbkdf2"
 )
 
-// Connect connects to the server
-func connectServer(config config.Config) net.Conn {
-	if config.Protocol == "kcp" {
-		key := pbkdf2.Key([]byte(config.Key), []byte("opensocks@2022"), 1024, 32, sha1.New)
-		block, _ := kcp.NewAESBlockCrypt(key)
-		c, err := kcp.DialWithOptions(config.ServerAddr, block, 10, 3)
-		if err != nil {
-			log.Printf("[client] failed to dial kcp server %s %v", config.ServerAddr, err)
-			return nil
-		}
-		c.SetWindowSize(enum.SndWnd, enum.RcvWnd)
-		if err := c.SetReadBuffer(enum.SockBuf); err != nil {
-			log.Println("[client] failed to set read buffer:", err)
-		}
-		log.Printf("[client] kcp server connected %s", config.ServerAddr)
-		return c
-
-	} else if config.Protocol == "tcp" {
-		c, err := net.DialTimeout("tcp", config.ServerAddr, time.Duration(enum.Timeout)*time.Second)
-		if err != nil {
-			log.Printf("[client] failed to dial tcp server %s %v", config.ServerAddr, err)
-			return nil
-		}
-		log.Printf("[client] tcp server connected %s", config.ServerAddr)
-		return c
-	} else {
-		url := fmt.Sprintf("%s://%s%s", config.Protocol, config.ServerAddr, enum.WSPath)
-		dialer := &ws.Dialer{ReadBufferSize: enum.BufferSize, WriteBufferSize: enum.BufferSize, Timeout: time.Duration(enum.Timeout) * time.Second}
-		c, _, _, err := dialer.Dial(context.Background(), url)
-		if err != nil {
-			log.Printf("[client] failed to dial websocket %s %v", url, err)
-			return nil
-		}
-		log.Printf("[client] ws server connected %s", url)
-		return c
+// Handshake handshake with the server sending the first payload if any, it returns the socks5 reply of the server
+func handshake(stream net.Conn, network string, host string, port string, first []byte, config config.Config, secret []byte) (*Codec, uint8, error) {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, enum.AddrTypeNotSupported, err
 	}
-}
-
-// Handshake handshake with the server
-func handshake(stream io.ReadWriteCloser, network string, host string, port string, key string, obfs bool) bool {
-	req := &RequestAddr{}
+	req := RequestAddr{Version: Version, Supported: Flags, Required: RequiredFlags(config)}
 	req.Network = network
 	req.Host = host
-	req.Port = port
-	req.Key = key
-	req.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
-	req.Random = cipher.Random()
+	req.Port = uint16(p)
+	req.Data = first
+	req.Timestamp = time.Now().Unix()
+	req.Random = make([]byte, RandomSize)
+	if _, err = rand.Read(req.Random); err != nil {
+		return nil, enum.ServerFailure, err
+	}
+	if err = req.Sign(config.Key); err != nil {
+		return nil, enum.ServerFailure, err
+	}
 	data, err := req.MarshalBinary()
 	if err != nil {
-		log.Printf("[client] failed to encode request %v", err)
-		return false
-	}
-	if obfs {
-		data = cipher.XOR(data)
+		return nil, enum.ServerFailure, err
 	}
 	encode, err := proto.Encode(data)
 	if err != nil {
-		log.Println(err)
-		return false
+		return nil, enum.ServerFailure, err
 	}
 	_, err = stream.Write(encode)
 	if err != nil {
-		log.Println(err)
-		return false
+		return nil, enum.ServerFailure, &streamError{err}
+	}
+	// wait for the signed ack, the server replies after dialing
+	stream.SetReadDeadline(time.Now().Add(time.Duration(2*enum.Timeout) * time.Second))
+	defer stream.SetReadDeadline(time.Time{})
+	b, _, err := proto.Decode(stream)
+	if err != nil {
+		return nil, enum.ServerFailure, fmt.Errorf("failed to read ack %v", err)
+	}
+	var ack Ack
+	if err = ack.UnmarshalBinary(b); err != nil {
+		return nil, enum.ServerFailure, fmt.Errorf("invalid ack from server %w", err)
+	}
+	if !ack.Verify(req, config.Key) {
+		return nil, enum.ServerFailure, errors.New("invalid ack from server")
+	}
+	if ack.Flags&^Flags != 0 {
+		return nil, enum.ServerFailure, fmt.Errorf("server requires unsupported flags %#x", ack.Flags&^Flags)
 	}
-	return true
+	if ack.Reply != enum.SuccessReply {
+		return nil, ack.Reply, nil
+	}
+	codec, err := NewCodec(ack.Flags, secret, req, false)
+	if err != nil {
+		return nil, enum.ServerFailure, err
+	}
+	return codec, enum.SuccessReply, nil
+}
+
+// The streamError struct is a failed write of the handshake to the stream
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *streamError) Unwrap() error {
+	return e.err
+}
+
+// sessionFailed returns true if the handshake failed on the stream or the session, not on the reply of the server
+func sessionFailed(session *Session, err error) bool {
+	var serr *streamError
+	return errors.As(err, &serr) || session.IsClosed()
 }
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/net-byte/opensocks/config"
+	"github.com/net-byte/opensocks/proto"
+)
+
+// replyAck reads the request from the stream and replies the ack returned by reply
+func replyAck(t *testing.T, stream net.Conn, reply func(req RequestAddr) []byte) {
+	t.Helper()
+	b, _, err := proto.Decode(stream)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var req RequestAddr
+	if err = req.UnmarshalBinary(b); err != nil {
+		t.Error(err)
+		return
+	}
+	encode, _ := proto.Encode(reply(req))
+	stream.Write(encode)
+}
+
+func TestHandshakeSessionFailed(t *testing.T) {
+	cfg := config.Config{Key: "key"}
+	tests := []struct {
+		name  string
+		reply func(req RequestAddr) []byte
+		drop  bool
+	}{
+		{"version", func(RequestAddr) []byte { return []byte{Version + 1, 0, 0} }, false},
+		{"unsupported flags", func(req RequestAddr) []byte {
+			b, _ := NewAck(req, cfg.Key, 0, 1<<7).MarshalBinary()
+			return b
+		}, false},
+		{"invalid ack", func(RequestAddr) []byte { return []byte{Version} }, false},
+		{"closed stream", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			if tt.reply == nil {
+				server.Close()
+			} else {
+				defer server.Close()
+				go replyAck(t, server, tt.reply)
+			}
+			session := &Session{Mux: &fakeMux{}}
+			_, _, err := handshake(client, "tcp", "example.com", "443", nil, cfg, make([]byte, 32))
+			if err == nil {
+				t.Fatal("handshake succeeded")
+			}
+			if sessionFailed(session, err) != tt.drop {
+				t.Fatalf("%v: got drop %v, want %v", err, !tt.drop, tt.drop)
+			}
+		})
+	}
+	var verr *VersionError
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go replyAck(t, server, tests[0].reply)
+	if _, _, err := handshake(client, "tcp", "example.com", "443", nil, cfg, make([]byte, 32)); !errors.As(err, &verr) {
+		t.Fatalf("got %v, want a version error", err)
+	}
+	session := &Session{Mux: &fakeMux{closed: true}}
+	if !sessionFailed(session, errors.New("failed to read ack")) {
+		t.Fatal("closed session not dropped")
+	}
+}
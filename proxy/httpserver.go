@@ -1,15 +1,20 @@
 package proxy
 
 import (
+	"encoding/base64"
 	"io"
+	"log"
 	"net"
 	"net/http"
+	"strings"
 
 	"golang.org/x/net/proxy"
 )
 
+// The http proxy handler forwards the requests to the local socks5 proxy
 type HttpProxyHandler struct {
-	Dialer proxy.Dialer
+	SocksAddr string
+	Accounts  map[string]string
 }
 
 func (h *HttpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -19,11 +24,31 @@ func (h *HttpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var auth *proxy.Auth
+	if len(h.Accounts) > 0 {
+		username, password, ok := proxyBasicAuth(r)
+		if !ok || !checkAccount(h.Accounts, username, password) {
+			if ok {
+				log.Printf("[http] failed to auth user %s from %v", username, r.RemoteAddr)
+			}
+			w.Header().Set("Proxy-Authenticate", `Basic realm="opensocks"`)
+			http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+			return
+		}
+		auth = &proxy.Auth{User: username, Password: password}
+		r.Header.Del("Proxy-Authorization")
+	}
+	dialer, err := proxy.SOCKS5("tcp", h.SocksAddr, auth, proxy.Direct)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	port := r.URL.Port()
 	if port == "" {
 		port = "80"
 	}
-	socksConn, err := h.Dialer.Dial("tcp", r.URL.Hostname()+":"+port)
+	socksConn, err := dialer.Dial("tcp", r.URL.Hostname()+":"+port)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
@@ -50,3 +75,17 @@ func (h *HttpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	go pipeConn(socksConn, httpConn)
 	pipeConn(httpConn, socksConn)
 }
+
+// proxyBasicAuth returns the username and password of the Proxy-Authorization header
+func proxyBasicAuth(r *http.Request) (username string, password string, ok bool) {
+	const prefix = "Basic "
+	header := r.Header.Get("Proxy-Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
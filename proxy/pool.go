@@ -0,0 +1,379 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/config"
+)
+
+const (
+	// minBackoff and maxBackoff bound the delay between the attempts rebuilding a session
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	// rebuildWait bounds the time a stream waits for the sessions being rebuilt
+	rebuildWait = 5 * time.Second
+)
+
+// The session pool struct opens the streams on the least loaded of its sessions to the server,
+// it pings the sessions and rebuilds the dead ones in the background
+type SessionPool struct {
+	config   config.Config
+	open     func(config.Config) (*Session, error)
+	after    func(time.Duration) <-chan time.Time
+	lock     sync.Mutex
+	slots    []*slot
+	ready    chan struct{}
+	watching bool
+	closed   bool
+	done     chan struct{}
+}
+
+// The slot struct is a session of the pool with the state of its rebuild
+type slot struct {
+	session  *Session
+	dialing  bool
+	failures int
+	err      error
+}
+
+// The session state struct is the state of a session of the pool
+type SessionState struct {
+	Index    int
+	State    string
+	Streams  int64
+	Failures int
+	Error    string
+}
+
+// NewSessionPool creates the pool of the config, the sessions are opened on demand
+func NewSessionPool(config config.Config) *SessionPool {
+	p := &SessionPool{
+		config: config,
+		open:   openSession,
+		after:  time.After,
+		slots:  make([]*slot, max(config.PoolSize, 1)),
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for i := range p.slots {
+		p.slots[i] = &slot{}
+	}
+	return p
+}
+
+// OpenStream opens a stream on the least loaded session, it returns the session for the handshake
+func (p *SessionPool) OpenStream() (net.Conn, *Session, error) {
+	var err error
+	// retry on the other sessions if the session is dead
+	for range len(p.slots) + 1 {
+		var session *Session
+		if session, err = p.pick(); err != nil {
+			return nil, nil, err
+		}
+		var stream net.Conn
+		if stream, err = session.OpenStream(); err == nil {
+			session.streams.Add(1)
+			return &poolStream{Conn: stream, session: session}, session, nil
+		}
+		p.Drop(session, err)
+	}
+	return nil, nil, err
+}
+
+// pick returns the least loaded live session, it opens one at once if none is live or being rebuilt,
+// otherwise it waits a bounded time for the rebuilds
+func (p *SessionPool) pick() (*Session, error) {
+	wait := p.after(rebuildWait)
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, errors.New("session pool closed")
+		}
+		if session := p.best(); session != nil {
+			p.lock.Unlock()
+			return session, nil
+		}
+		rebuilding := false
+		for _, s := range p.slots {
+			rebuilding = rebuilding || s.dialing
+		}
+		if !rebuilding {
+			// dial the first slot, the other requests wait for it as a rebuild
+			s := p.slots[0]
+			s.dialing = true
+			p.lock.Unlock()
+			session, err := p.open(p.config)
+			p.lock.Lock()
+			if p.closed {
+				s.dialing = false
+				p.lock.Unlock()
+				if err == nil {
+					session.Close()
+				}
+				return nil, errors.New("session pool closed")
+			}
+			if err != nil {
+				p.failed(0, err)
+				p.lock.Unlock()
+				return nil, err
+			}
+			p.opened(0, session)
+			p.fill()
+			p.lock.Unlock()
+			return session, nil
+		}
+		ready := p.ready
+		p.lock.Unlock()
+		select {
+		case <-ready:
+		case <-wait:
+			return nil, p.lastError()
+		case <-p.done:
+			return nil, errors.New("session pool closed")
+		}
+	}
+}
+
+// lastError returns the error of the last attempt opening a session
+func (p *SessionPool) lastError() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, s := range p.slots {
+		if s.err != nil {
+			return fmt.Errorf("no session to the server, reconnecting %v", s.err)
+		}
+	}
+	return errors.New("no session to the server, reconnecting")
+}
+
+// best returns the live session with the fewest open streams, it rebuilds the empty slots once a session is live,
+// the lock must be held
+func (p *SessionPool) best() *Session {
+	var best *Session
+	for i, s := range p.slots {
+		if s.session != nil && s.session.IsClosed() {
+			p.lost(i, errors.New("session closed"))
+		}
+		if s.session != nil && (best == nil || s.session.streams.Load() < best.streams.Load()) {
+			best = s.session
+		}
+	}
+	if best != nil {
+		p.fill()
+	}
+	return best
+}
+
+// fill rebuilds the empty slots in the background, the lock must be held
+func (p *SessionPool) fill() {
+	for i, s := range p.slots {
+		if s.session == nil && !s.dialing {
+			s.dialing = true
+			go p.rebuild(i, 0)
+		}
+	}
+}
+
+// lost empties the slot of a dead session and rebuilds it, the lock must be held
+func (p *SessionPool) lost(i int, err error) {
+	log.Printf("[client] session %d of %d lost %v", i+1, len(p.slots), err)
+	s := p.slots[i]
+	s.session = nil
+	if !s.dialing && !p.closed {
+		s.dialing = true
+		go p.rebuild(i, 0)
+	}
+}
+
+// opened fills the slot with the session and wakes the streams waiting for it, the lock must be held
+func (p *SessionPool) opened(i int, session *Session) {
+	s := p.slots[i]
+	s.session, s.dialing, s.failures, s.err = session, false, 0, nil
+	log.Printf("[client] session %d of %d opened", i+1, len(p.slots))
+	if !p.watching {
+		p.watching = true
+		go p.watch()
+	}
+	close(p.ready)
+	p.ready = make(chan struct{})
+}
+
+// failed records the failed attempt of the slot and rebuilds it after the first backoff, the lock must be held
+func (p *SessionPool) failed(i int, err error) {
+	s := p.slots[i]
+	s.failures++
+	s.err = err
+	log.Printf("[client] failed to open session %d of %d %v, retry in %v", i+1, len(p.slots), err, minBackoff)
+	go p.rebuild(i, minBackoff)
+}
+
+// rebuild opens the session of the slot after the delay, retrying with an exponential backoff
+// until it is opened or the pool is closed
+func (p *SessionPool) rebuild(i int, delay time.Duration) {
+	backoff := minBackoff
+	if delay > 0 {
+		backoff = min(delay*2, maxBackoff)
+	}
+	for {
+		if delay > 0 {
+			select {
+			case <-p.after(delay):
+			case <-p.done:
+				p.lock.Lock()
+				p.slots[i].dialing = false
+				p.lock.Unlock()
+				return
+			}
+		}
+		session, err := p.open(p.config)
+		p.lock.Lock()
+		s := p.slots[i]
+		if s.session != nil || p.closed {
+			s.dialing = false
+			p.lock.Unlock()
+			if err == nil {
+				session.Close()
+			}
+			return
+		}
+		if err == nil {
+			p.opened(i, session)
+			p.lock.Unlock()
+			return
+		}
+		s.failures++
+		s.err = err
+		p.lock.Unlock()
+		log.Printf("[client] failed to open session %d of %d %v, retry in %v", i+1, len(p.slots), err, backoff)
+		delay, backoff = backoff, min(backoff*2, maxBackoff)
+	}
+}
+
+// watch pings the live sessions every keepalive interval, the sessions failing the ping are dropped and rebuilt
+func (p *SessionPool) watch() {
+	ticker := time.NewTicker(time.Duration(p.config.KeepAlive) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+		p.lock.Lock()
+		for _, s := range p.slots {
+			if s.session != nil {
+				go p.ping(s.session)
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// ping drops the session if the server does not reply to a ping request within the keepalive timeout
+func (p *SessionPool) ping(session *Session) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		p.Drop(session, err)
+		return
+	}
+	defer stream.Close()
+	timeout := time.Duration(p.config.KeepAliveTimeout) * time.Second
+	var expired atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		expired.Store(true)
+		stream.Close()
+	})
+	defer timer.Stop()
+	_, rep, err := handshake(stream, "ping", "", "0", nil, p.config, session.Secret)
+	if expired.Load() {
+		err = fmt.Errorf("no ping reply within %v", timeout)
+	} else if err == nil && rep != enum.SuccessReply {
+		err = fmt.Errorf("ping reply %v", rep)
+	}
+	if err != nil {
+		p.Drop(session, err)
+	}
+}
+
+// Drop removes the broken session from the pool and rebuilds it, the session is closed once its streams are closed
+func (p *SessionPool) Drop(session *Session, err error) {
+	p.lock.Lock()
+	for i, s := range p.slots {
+		if s.session == session {
+			p.lost(i, err)
+		}
+	}
+	p.lock.Unlock()
+	session.dropped.Store(true)
+	if session.streams.Load() == 0 {
+		session.Close()
+	}
+}
+
+// State returns the state of the sessions of the pool
+func (p *SessionPool) State() []SessionState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	states := make([]SessionState, len(p.slots))
+	for i, s := range p.slots {
+		states[i] = SessionState{Index: i + 1, State: "idle", Failures: s.failures}
+		if s.session != nil {
+			states[i].State = "connected"
+			states[i].Streams = s.session.streams.Load()
+		} else if s.dialing {
+			states[i].State = "reconnecting"
+		}
+		if s.err != nil {
+			states[i].Error = s.err.Error()
+		}
+	}
+	return states
+}
+
+// Close stops the rebuilds and closes the sessions of the pool
+func (p *SessionPool) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	var sessions []*Session
+	for _, s := range p.slots {
+		if s.session != nil {
+			sessions = append(sessions, s.session)
+			s.session = nil
+		}
+	}
+	p.lock.Unlock()
+	// the sessions are closed without the lock as closing may wait for a stuck write
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+// The pool stream struct releases the load of its session when it is closed
+type poolStream struct {
+	net.Conn
+	session *Session
+	once    sync.Once
+}
+
+func (s *poolStream) Close() error {
+	err := s.Conn.Close()
+	s.once.Do(func() {
+		if s.session.streams.Add(-1) == 0 && s.session.dropped.Load() {
+			s.session.Close()
+		}
+	})
+	return err
+}
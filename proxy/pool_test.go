@@ -0,0 +1,373 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/net-byte/opensocks/config"
+)
+
+// The fake mux struct opens piped streams until it is closed
+type fakeMux struct {
+	lock   sync.Mutex
+	closed bool
+	stuck  chan struct{}
+}
+
+func (m *fakeMux) OpenStream() (net.Conn, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, errors.New("mux closed")
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (m *fakeMux) IsClosed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.closed
+}
+
+func (m *fakeMux) Close() error {
+	if m.stuck != nil {
+		<-m.stuck
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	return nil
+}
+
+// The fake opener struct opens the fake sessions of the pool, it fails while err is set and waits for block if set
+type fakeOpener struct {
+	lock     sync.Mutex
+	calls    int
+	err      error
+	block    chan struct{}
+	sessions []*Session
+}
+
+func (o *fakeOpener) open(config.Config) (*Session, error) {
+	o.lock.Lock()
+	o.calls++
+	block, err := o.block, o.err
+	o.lock.Unlock()
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{Mux: &fakeMux{}}
+	o.lock.Lock()
+	o.sessions = append(o.sessions, session)
+	o.lock.Unlock()
+	return session, nil
+}
+
+func (o *fakeOpener) count() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.calls
+}
+
+// never returns a channel which never fires
+func never(time.Duration) <-chan time.Time {
+	return nil
+}
+
+func newTestPool(t *testing.T, size int, o *fakeOpener, after func(time.Duration) <-chan time.Time) *SessionPool {
+	t.Helper()
+	p := NewSessionPool(config.Config{PoolSize: size, KeepAlive: 3600, KeepAliveTimeout: 3600})
+	p.open, p.after = o.open, after
+	t.Cleanup(p.Close)
+	return p
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func connected(p *SessionPool) bool {
+	for _, s := range p.State() {
+		if s.State != "connected" {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPoolLeastLoaded(t *testing.T) {
+	p := newTestPool(t, 2, &fakeOpener{}, time.After)
+	s1, a, err := p.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the sessions", func() bool { return connected(p) })
+	s2, b, err := p.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("second stream opened on the loaded session")
+	}
+	s1.Close()
+	s3, c, err := p.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != a {
+		t.Fatal("stream not opened on the idle session")
+	}
+	s2.Close()
+	s3.Close()
+	// closing twice releases the load once
+	s3.Close()
+	if a.streams.Load() != 0 || b.streams.Load() != 0 {
+		t.Fatalf("got %d and %d streams, want none", a.streams.Load(), b.streams.Load())
+	}
+}
+
+func TestPoolDropThenClose(t *testing.T) {
+	o := &fakeOpener{}
+	p := newTestPool(t, 1, o, time.After)
+	stream, session, err := p.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Drop(session, errors.New("broken"))
+	if session.IsClosed() {
+		t.Fatal("dropped session closed with an open stream")
+	}
+	waitFor(t, "the rebuilt session", func() bool { return connected(p) })
+	stream.Close()
+	if !session.IsClosed() {
+		t.Fatal("dropped session not closed after its last stream")
+	}
+	// the rebuilt session without streams is closed at once
+	stream, rebuilt, err := p.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt == session {
+		t.Fatal("stream opened on the dropped session")
+	}
+	stream.Close()
+	p.Drop(rebuilt, errors.New("broken"))
+	if !rebuilt.IsClosed() {
+		t.Fatal("dropped session without streams not closed")
+	}
+}
+
+func TestPoolPingDrops(t *testing.T) {
+	p := newTestPool(t, 1, &fakeOpener{}, time.After)
+	stream, session, err := p.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	// the session failing to open the ping stream is dropped and rebuilt
+	session.Mux.Close()
+	p.ping(session)
+	if !session.dropped.Load() {
+		t.Fatal("session failing the ping not dropped")
+	}
+	waitFor(t, "the rebuilt session", func() bool { return connected(p) })
+	if _, rebuilt, err := p.OpenStream(); err != nil || rebuilt == session {
+		t.Fatalf("got %v, want a stream on the rebuilt session", err)
+	}
+}
+
+func TestPoolDropConcurrent(t *testing.T) {
+	o := &fakeOpener{}
+	p := newTestPool(t, 2, o, time.After)
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				stream, session, err := p.OpenStream()
+				if err != nil {
+					continue
+				}
+				if i%4 == 0 {
+					p.Drop(session, errors.New("broken"))
+				}
+				stream.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, session := range o.sessions {
+		if session.dropped.Load() && !session.IsClosed() {
+			t.Fatal("dropped session not closed after its streams")
+		}
+		if n := session.streams.Load(); n != 0 {
+			t.Fatalf("got %d streams left, want none", n)
+		}
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	o := &fakeOpener{err: errors.New("refused")}
+	var lock sync.Mutex
+	var delays []time.Duration
+	fired := make(chan time.Time)
+	close(fired)
+	p := newTestPool(t, 1, o, func(d time.Duration) <-chan time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		if d == rebuildWait || len(delays) == 10 {
+			return nil
+		}
+		delays = append(delays, d)
+		return fired
+	})
+	if _, _, err := p.OpenStream(); err == nil {
+		t.Fatal("stream opened without a server")
+	}
+	waitFor(t, "the retries", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(delays) == 10
+	})
+	want := []time.Duration{1, 2, 4, 8, 16, 32, 60, 60, 60, 60}
+	lock.Lock()
+	defer lock.Unlock()
+	for i, d := range delays {
+		if d != want[i]*time.Second {
+			t.Fatalf("got the delays %v", delays)
+		}
+	}
+	waitFor(t, "the failures", func() bool { return p.State()[0].Failures == 11 })
+	if state := p.State()[0]; state.State != "reconnecting" || state.Error != "refused" {
+		t.Fatalf("got the state %+v", state)
+	}
+}
+
+func TestPoolWaitsForRebuild(t *testing.T) {
+	o := &fakeOpener{err: errors.New("refused")}
+	fired := make(chan time.Time)
+	close(fired)
+	p := newTestPool(t, 1, o, func(d time.Duration) <-chan time.Time {
+		if d == rebuildWait {
+			return fired
+		}
+		return nil
+	})
+	if _, _, err := p.OpenStream(); err == nil {
+		t.Fatal("stream opened without a server")
+	}
+	// the streams fail without dialing while the rebuild waits for its backoff
+	for range 5 {
+		if _, _, err := p.OpenStream(); err == nil {
+			t.Fatal("stream opened without a server")
+		}
+	}
+	if n := o.count(); n != 1 {
+		t.Fatalf("got %d dials, want 1", n)
+	}
+}
+
+func TestPoolWakesOnRebuild(t *testing.T) {
+	o := &fakeOpener{block: make(chan struct{})}
+	p := newTestPool(t, 1, o, time.After)
+	errs := make(chan error, 5)
+	for range cap(errs) {
+		go func() {
+			stream, _, err := p.OpenStream()
+			if err == nil {
+				stream.Close()
+			}
+			errs <- err
+		}()
+	}
+	waitFor(t, "the dial", func() bool { return o.count() == 1 })
+	close(o.block)
+	for range cap(errs) {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := o.count(); n != 1 {
+		t.Fatalf("got %d dials, want 1", n)
+	}
+}
+
+func TestPoolCloseStopsRebuilds(t *testing.T) {
+	o := &fakeOpener{err: errors.New("refused")}
+	p := newTestPool(t, 2, o, never)
+	if _, _, err := p.OpenStream(); err == nil {
+		t.Fatal("stream opened without a server")
+	}
+	p.Close()
+	waitFor(t, "the rebuilds", func() bool {
+		for _, s := range p.State() {
+			if s.State != "idle" {
+				return false
+			}
+		}
+		return true
+	})
+	calls := o.count()
+	if _, _, err := p.OpenStream(); err == nil {
+		t.Fatal("stream opened on a closed pool")
+	}
+	if o.count() != calls {
+		t.Fatal("closed pool dialed")
+	}
+}
+
+func TestPoolCloseDuringDial(t *testing.T) {
+	o := &fakeOpener{block: make(chan struct{})}
+	p := newTestPool(t, 1, o, never)
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := p.OpenStream()
+		errs <- err
+	}()
+	waitFor(t, "the dial", func() bool { return o.count() == 1 })
+	p.Close()
+	close(o.block)
+	if err := <-errs; err == nil {
+		t.Fatal("stream opened on a closed pool")
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.sessions) != 1 || !o.sessions[0].IsClosed() {
+		t.Fatal("session opened after close not closed")
+	}
+	if state := p.State()[0]; state.State != "idle" {
+		t.Fatalf("got the state %+v", state)
+	}
+}
+
+func TestPoolCloseStuckSession(t *testing.T) {
+	o := &fakeOpener{}
+	p := newTestPool(t, 1, o, never)
+	stream, session, err := p.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stuck := make(chan struct{})
+	defer close(stuck)
+	session.Mux.(*fakeMux).stuck = stuck
+	go p.Close()
+	// the pool is usable while a session is slow to close
+	waitFor(t, "the close", func() bool { return p.State()[0].State == "idle" })
+}
@@ -1,25 +1,196 @@
 package proxy
 
 import (
-	"encoding/json"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/net-byte/opensocks/common/cipher"
+	"github.com/net-byte/opensocks/config"
+)
+
+const (
+	// Version is the version of the stream handshake
+	Version uint8 = 1
+	// FlagObfs and FlagCompress are the stream features negotiated by the handshake
+	FlagObfs     uint8 = 1 << 0
+	FlagCompress uint8 = 1 << 1
+	// Flags are the features supported by this version
+	Flags = FlagObfs | FlagCompress
+	// RandomSize is the size of the random of the request
+	RandomSize = 16
+	// SignatureSize is the size of the signatures
+	SignatureSize = 32
+	// MaxDataSize is the max size of the first payload carried by the request
+	MaxDataSize = 16 * 1024
 )
 
+// _networks are the networks of the requests, the ping requests check the session is alive
+var _networks = []string{"", "tcp", "udp", "ping"}
+
+// The version error struct is returned when the peer speaks another handshake version
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported handshake version %d, expected %d", e.Version, Version)
+}
+
+// RequiredFlags returns the stream features required by the config
+func RequiredFlags(config config.Config) uint8 {
+	var flags uint8
+	if config.Obfs {
+		flags |= FlagObfs
+	}
+	if config.Compress {
+		flags |= FlagCompress
+	}
+	return flags
+}
+
 // The Request address struct
 type RequestAddr struct {
-	Host      string
-	Port      string
-	Key       string
+	Version   uint8
+	Supported uint8
+	Required  uint8
 	Network   string
-	Timestamp string
-	Random    string
+	Host      string
+	Port      uint16
+	Data      []byte
+	Timestamp int64
+	Random    []byte
+	Signature []byte
 }
 
 // MarshalBinary marshals the RequestAddr
 func (r *RequestAddr) MarshalBinary() ([]byte, error) {
-	return json.Marshal(r)
+	b, err := r.body()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, r.Signature...), nil
 }
 
-// UmarshalBinary unmarshals the RequestAddr
+// UnmarshalBinary unmarshals the RequestAddr, it returns a VersionError if the version differs
 func (r *RequestAddr) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, &r)
+	if len(data) > 0 && data[0] != Version {
+		return &VersionError{Version: data[0]}
+	}
+	size := 4 + 8 + RandomSize + 1
+	if len(data) < size {
+		return errors.New("invalid request length")
+	}
+	hostSize := int(data[size-1])
+	if len(data) < size+hostSize+4+SignatureSize {
+		return errors.New("invalid request length")
+	}
+	dataSize := int(binary.BigEndian.Uint16(data[size+hostSize+2:]))
+	if dataSize > MaxDataSize {
+		return errors.New("invalid request data")
+	}
+	if len(data) != size+hostSize+4+dataSize+SignatureSize {
+		return errors.New("invalid request length")
+	}
+	if int(data[3]) == 0 || int(data[3]) >= len(_networks) {
+		return errors.New("invalid request network")
+	}
+	r.Version, r.Supported, r.Required, r.Network = data[0], data[1], data[2], _networks[data[3]]
+	r.Timestamp = int64(binary.BigEndian.Uint64(data[4:]))
+	r.Random = append([]byte{}, data[12:12+RandomSize]...)
+	r.Host = string(data[size : size+hostSize])
+	r.Port = binary.BigEndian.Uint16(data[size+hostSize:])
+	r.Data = append([]byte{}, data[size+hostSize+4:size+hostSize+4+dataSize]...)
+	r.Signature = append([]byte{}, data[size+hostSize+4+dataSize:]...)
+	return nil
+}
+
+// body returns the signed part of the RequestAddr
+func (r *RequestAddr) body() ([]byte, error) {
+	network := 0
+	for i, n := range _networks {
+		if n != "" && n == r.Network {
+			network = i
+		}
+	}
+	if network == 0 {
+		return nil, errors.New("invalid request network")
+	}
+	if len(r.Host) > 255 {
+		return nil, errors.New("invalid request host")
+	}
+	if len(r.Random) != RandomSize {
+		return nil, errors.New("invalid request random")
+	}
+	if len(r.Data) > MaxDataSize {
+		return nil, errors.New("invalid request data")
+	}
+	b := []byte{r.Version, r.Supported, r.Required, uint8(network)}
+	b = binary.BigEndian.AppendUint64(b, uint64(r.Timestamp))
+	b = append(b, r.Random...)
+	b = append(b, uint8(len(r.Host)))
+	b = append(b, r.Host...)
+	b = binary.BigEndian.AppendUint16(b, r.Port)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+	return append(b, r.Data...), nil
+}
+
+// Sign signs the RequestAddr with the key
+func (r *RequestAddr) Sign(key string) error {
+	b, err := r.body()
+	if err != nil {
+		return err
+	}
+	r.Signature = cipher.MAC(key, "request", string(b))
+	return nil
+}
+
+// Verify verifies the signature of the RequestAddr
+func (r *RequestAddr) Verify(key string) bool {
+	b, err := r.body()
+	return err == nil && hmac.Equal(r.Signature, cipher.MAC(key, "request", string(b)))
+}
+
+// The handshake acknowledgement struct, the reply is a socks5 reply code and the flags are the agreed features
+type Ack struct {
+	Version   uint8
+	Reply     uint8
+	Flags     uint8
+	Signature []byte
+}
+
+// NewAck creates the acknowledgement of the request signed with the key
+func NewAck(req RequestAddr, key string, reply uint8, flags uint8) *Ack {
+	a := &Ack{Version: Version, Reply: reply, Flags: flags}
+	a.Signature = cipher.MAC(key, "ack", string(req.Signature), string(a.body()))
+	return a
+}
+
+// MarshalBinary marshals the Ack
+func (a *Ack) MarshalBinary() ([]byte, error) {
+	return append(a.body(), a.Signature...), nil
+}
+
+// UnmarshalBinary unmarshals the Ack, it returns a VersionError if the version differs
+func (a *Ack) UnmarshalBinary(data []byte) error {
+	if len(data) > 0 && data[0] != Version {
+		return &VersionError{Version: data[0]}
+	}
+	if len(data) != 3+SignatureSize {
+		return errors.New("invalid ack length")
+	}
+	a.Version, a.Reply, a.Flags = data[0], data[1], data[2]
+	a.Signature = append([]byte{}, data[3:]...)
+	return nil
+}
+
+// body returns the signed part of the Ack
+func (a *Ack) body() []byte {
+	return []byte{a.Version, a.Reply, a.Flags}
+}
+
+// Verify verifies the Ack belongs to the request
+func (a *Ack) Verify(req RequestAddr, key string) bool {
+	return hmac.Equal(a.Signature, cipher.MAC(key, "ack", string(req.Signature), string(a.body())))
 }
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func testRequest(t *testing.T, host string, data []byte) ([]byte, RequestAddr) {
+	t.Helper()
+	req := RequestAddr{
+		Version:   Version,
+		Supported: Flags,
+		Required:  FlagObfs,
+		Network:   "tcp",
+		Host:      host,
+		Port:      443,
+		Data:      data,
+		Timestamp: 1700000000,
+		Random:    bytes.Repeat([]byte{7}, RandomSize),
+	}
+	if err := req.Sign("key"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := req.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, req
+}
+
+func TestRequestAddrRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		data []byte
+	}{
+		{"domain", "example.com", nil},
+		{"ip with data", "10.0.0.1", []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"empty host", "", nil},
+		{"max host", string(bytes.Repeat([]byte{'a'}, 255)), nil},
+		{"max data", "example.com", bytes.Repeat([]byte{1}, MaxDataSize)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, req := testRequest(t, tt.host, tt.data)
+			var got RequestAddr
+			if err := got.UnmarshalBinary(b); err != nil {
+				t.Fatal(err)
+			}
+			if got.Version != req.Version || got.Supported != req.Supported || got.Required != req.Required ||
+				got.Network != req.Network || got.Host != req.Host || got.Port != req.Port || got.Timestamp != req.Timestamp ||
+				!bytes.Equal(got.Random, req.Random) || !bytes.Equal(got.Data, req.Data) || !bytes.Equal(got.Signature, req.Signature) {
+				t.Fatalf("got %+v, want %+v", got, req)
+			}
+			if !got.Verify("key") {
+				t.Fatal("signature not verified")
+			}
+			if got.Verify("other") {
+				t.Fatal("signature verified with another key")
+			}
+		})
+	}
+}
+
+func TestRequestAddrTruncated(t *testing.T) {
+	host, data := "example.com", []byte("payload")
+	b, _ := testRequest(t, host, data)
+	hostAt := 4 + 8 + RandomSize + 1
+	dataAt := hostAt + len(host) + 4
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"flags", 2},
+		{"network", 3},
+		{"timestamp", 4 + 4},
+		{"random", 4 + 8 + RandomSize/2},
+		{"host size", hostAt - 1},
+		{"host", hostAt + 3},
+		{"port", hostAt + len(host) + 1},
+		{"data size", hostAt + len(host) + 3},
+		{"data", dataAt + 3},
+		{"signature", dataAt + len(data) + SignatureSize/2},
+		{"last byte", len(b) - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req RequestAddr
+			if err := req.UnmarshalBinary(b[:tt.size]); err == nil {
+				t.Fatalf("truncated to %d bytes accepted", tt.size)
+			}
+		})
+	}
+	for size := range len(b) {
+		var req RequestAddr
+		if err := req.UnmarshalBinary(b[:size]); err == nil {
+			t.Fatalf("truncated to %d bytes accepted", size)
+		}
+	}
+	var req RequestAddr
+	if err := req.UnmarshalBinary(append(b, 0)); err == nil {
+		t.Fatal("trailing byte accepted")
+	}
+}
+
+func TestRequestAddrInvalid(t *testing.T) {
+	host := "example.com"
+	dataSizeAt := 4 + 8 + RandomSize + 1 + len(host) + 2
+	tests := []struct {
+		name   string
+		mutate func([]byte) []byte
+	}{
+		{"oversized data length", func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[dataSizeAt:], MaxDataSize+1)
+			return b
+		}},
+		{"oversized data", func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[dataSizeAt:], MaxDataSize+1)
+			sig := append([]byte{}, b[len(b)-SignatureSize:]...)
+			return append(append(b[:len(b)-SignatureSize], make([]byte, MaxDataSize+1)...), sig...)
+		}},
+		{"data length past the end", func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[dataSizeAt:], 100)
+			return b
+		}},
+		{"host size past the end", func(b []byte) []byte {
+			b[4+8+RandomSize] = 255
+			return b
+		}},
+		{"zero network", func(b []byte) []byte {
+			b[3] = 0
+			return b
+		}},
+		{"unknown network", func(b []byte) []byte {
+			b[3] = uint8(len(_networks))
+			return b
+		}},
+		{"max network", func(b []byte) []byte {
+			b[3] = 255
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := testRequest(t, host, nil)
+			var req RequestAddr
+			if err := req.UnmarshalBinary(tt.mutate(b)); err == nil {
+				t.Fatal("invalid request accepted")
+			}
+		})
+	}
+}
+
+func TestRequestAddrVersion(t *testing.T) {
+	b, _ := testRequest(t, "example.com", nil)
+	for _, version := range []uint8{0, Version + 1, 255} {
+		b[0] = version
+		var req RequestAddr
+		var verr *VersionError
+		if err := req.UnmarshalBinary(b); !errors.As(err, &verr) || verr.Version != version {
+			t.Fatalf("version %d: got %v, want a version error", version, err)
+		}
+	}
+	var ack Ack
+	var verr *VersionError
+	if err := ack.UnmarshalBinary([]byte{Version + 1, 0, 0}); !errors.As(err, &verr) {
+		t.Fatalf("got %v, want a version error", err)
+	}
+}
+
+func TestRequestAddrMarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		req  RequestAddr
+	}{
+		{"unknown network", RequestAddr{Network: "sctp", Random: make([]byte, RandomSize)}},
+		{"long host", RequestAddr{Network: "tcp", Host: string(make([]byte, 256)), Random: make([]byte, RandomSize)}},
+		{"short random", RequestAddr{Network: "tcp", Random: make([]byte, RandomSize-1)}},
+		{"oversized data", RequestAddr{Network: "tcp", Random: make([]byte, RandomSize), Data: make([]byte, MaxDataSize+1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.req.MarshalBinary(); err == nil {
+				t.Fatal("invalid request marshaled")
+			}
+		})
+	}
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	_, req := testRequest(t, "example.com", nil)
+	b, err := NewAck(req, "key", 0, FlagObfs).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ack Ack
+	if err = ack.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Flags != FlagObfs || !ack.Verify(req, "key") {
+		t.Fatalf("got %+v", ack)
+	}
+	for size := range len(b) {
+		if err = ack.UnmarshalBinary(b[:size]); err == nil {
+			t.Fatalf("truncated to %d bytes accepted", size)
+		}
+	}
+}
@@ -20,8 +20,8 @@ func resp(conn net.Conn, rep byte) {
 	conn.Write([]byte{enum.Socks5Version, rep, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 }
 
-// respNoAuth is a no auth response
-func respNoAuth(conn net.Conn) {
+// respMethod is a method selection response
+func respMethod(conn net.Conn, method byte) {
 	/**
 	  +----+--------+
 	  |VER | METHOD |
@@ -29,7 +29,19 @@ func respNoAuth(conn net.Conn) {
 	  | 1  |   1    |
 	  +----+--------+
 	*/
-	conn.Write([]byte{enum.Socks5Version, enum.NoAuth})
+	conn.Write([]byte{enum.Socks5Version, method})
+}
+
+// respAuth is a username/password auth response
+func respAuth(conn net.Conn, status byte) {
+	/**
+	  +----+--------+
+	  |VER | STATUS |
+	  +----+--------+
+	  | 1  |   1    |
+	  +----+--------+
+	*/
+	conn.Write([]byte{enum.UserAuthVersion, status})
 }
 
 // respSuccess is a success response
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-byte/opensocks/common/cipher"
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/config"
+	"github.com/net-byte/opensocks/proto"
+	"github.com/net-byte/opensocks/transport"
+	"github.com/xtaci/smux"
+)
+
+// The Mux interface opens the streams of a session
+type Mux interface {
+	OpenStream() (net.Conn, error)
+	IsClosed() bool
+	Close() error
+}
+
+// The Session struct is a multiplexed session with the secret of the key exchange and the count of its open streams
+type Session struct {
+	Mux
+	Secret  []byte
+	streams atomic.Int64
+	dropped atomic.Bool
+}
+
+// The smux session struct opens the streams of a smux session
+type smuxSession struct {
+	*smux.Session
+}
+
+func (s smuxSession) OpenStream() (net.Conn, error) {
+	stream, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// The native session struct opens the native streams of a transport, each stream is sealed with its own keys
+// derived from the session secret and the random salt the stream starts with
+type nativeSession struct {
+	transport.Muxer
+	secret  []byte
+	padding bool
+}
+
+func (s nativeSession) OpenStream() (net.Conn, error) {
+	stream, err := s.Muxer.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, cipher.SaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if _, err = stream.Write(salt); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	secure, err := cipher.NewStreamConn(stream, s.secret, salt, false, s.padding)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return secure, nil
+}
+
+// openSession dials the transport of the protocol, exchanges the session keys and opens the session
+func openSession(config config.Config) (*Session, error) {
+	t, err := transport.Get(config.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.Dial(config)
+	if err != nil {
+		return nil, err
+	}
+	muxer, native := conn.(transport.Muxer)
+	secure, secret, err := exchange(conn, config.Key, config.Padding)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if native {
+		return &Session{Mux: nativeSession{Muxer: muxer, secret: secret, padding: config.Padding}, Secret: secret}, nil
+	}
+	session, err := smux.Client(secure, SmuxConfig(config))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Session{Mux: smuxSession{Session: session}, Secret: secret}, nil
+}
+
+// SmuxConfig returns the smux config of the client and the server with the keepalive of the config
+func SmuxConfig(config config.Config) *smux.Config {
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.Version = enum.SmuxVer
+	smuxConfig.MaxReceiveBuffer = enum.SmuxBuf
+	smuxConfig.MaxStreamBuffer = enum.StreamBuf
+	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+	smuxConfig.KeepAliveTimeout = time.Duration(config.KeepAliveTimeout) * time.Second
+	return smuxConfig
+}
+
+// exchange exchanges the ephemeral keys with the server, the key only authenticates the exchange
+func exchange(conn net.Conn, key string, padding bool) (net.Conn, []byte, error) {
+	priv, err := cipher.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	hello := proto.Hello{PublicKey: priv.PublicKey().Bytes(), Timestamp: time.Now().Unix(), Nonce: make([]byte, proto.NonceSize)}
+	if _, err = rand.Read(hello.Nonce); err != nil {
+		return nil, nil, err
+	}
+	hello.MAC = cipher.MAC(key, hello.Signed()...)
+	b, err := hello.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(enum.Timeout) * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err = conn.Write(b); err != nil {
+		return nil, nil, err
+	}
+	rb := make([]byte, proto.HelloReplySize)
+	if _, err = io.ReadFull(conn, rb); err != nil {
+		return nil, nil, err
+	}
+	var reply proto.HelloReply
+	if err = reply.UnmarshalBinary(rb); err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal(reply.MAC, cipher.MAC(key, reply.Signed(b)...)) {
+		return nil, nil, errors.New("invalid hello reply")
+	}
+	secret, err := cipher.SessionSecret(priv, reply.PublicKey, append(b, reply.PublicKey...))
+	if err != nil {
+		return nil, nil, err
+	}
+	secure, err := cipher.NewConn(conn, secret, false, padding)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secure, secret, nil
+}
@@ -1,27 +1,27 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net"
 	"strconv"
-	"sync"
+	"time"
 
-	"github.com/golang/snappy"
-	"github.com/net-byte/opensocks/common/cipher"
 	"github.com/net-byte/opensocks/common/enum"
 	"github.com/net-byte/opensocks/common/pool"
 	"github.com/net-byte/opensocks/common/util"
 	"github.com/net-byte/opensocks/config"
 	"github.com/net-byte/opensocks/counter"
-	"github.com/xtaci/smux"
 )
 
+// firstDataTimeout is the time waiting for the first payload in optimistic mode
+const firstDataTimeout = 50 * time.Millisecond
+
 // The tcp proxy struct
 type TCPProxy struct {
-	Config  config.Config
-	Session *smux.Session
-	Lock    sync.Mutex
+	Config config.Config
+	Pool   *SessionPool
 }
 
 // Proxy is a function to proxy data
@@ -35,49 +35,58 @@ func (t *TCPProxy) Proxy(conn net.Conn, data []byte) {
 		directProxy(conn, host, port, t.Config)
 		return
 	}
-	t.Lock.Lock()
-	if t.Session == nil {
-		var err error
-		wsconn := connectServer(t.Config)
-		if wsconn == nil {
-			t.Lock.Unlock()
-			resp(conn, enum.ConnectionRefused)
-			return
-		}
-		smuxConfig := smux.DefaultConfig()
-		smuxConfig.Version = enum.SmuxVer
-		smuxConfig.MaxReceiveBuffer = enum.SmuxBuf
-		smuxConfig.MaxStreamBuffer = enum.StreamBuf
-		t.Session, err = smux.Client(wsconn, smuxConfig)
-		if err != nil || t.Session == nil {
-			t.Lock.Unlock()
-			util.PrintLog(t.Config.Verbose, "failed to open client:%v", err)
-			resp(conn, enum.ConnectionRefused)
-			return
-		}
+	// reply at once and send the first payload with the handshake in optimistic mode
+	var first []byte
+	if t.Config.Optimistic {
+		resp(conn, enum.SuccessReply)
+		first = readFirst(conn)
+	}
+	stream, session, err := t.Pool.OpenStream()
+	if err != nil {
+		log.Printf("[tcp] failed to open session %v", err)
+		t.reply(conn, enum.ConnectionRefused)
+		return
 	}
-	t.Lock.Unlock()
-	stream, err := t.Session.Open()
+	codec, rep, err := handshake(stream, "tcp", host, port, first, t.Config, session.Secret)
 	if err != nil {
-		t.Session = nil
-		util.PrintLog(t.Config.Verbose, "failed to open session:%v", err)
-		resp(conn, enum.ConnectionRefused)
+		stream.Close()
+		if sessionFailed(session, err) {
+			t.Pool.Drop(session, err)
+		}
+		log.Printf("[tcp] failed to handshake %v", err)
+		t.reply(conn, enum.ConnectionRefused)
 		return
 	}
-	ok := handshake(stream, "tcp", host, port, t.Config.Key, t.Config.Obfs)
-	if !ok {
-		t.Session = nil
-		log.Println("[tcp] failed to handshake")
-		resp(conn, enum.ConnectionRefused)
+	if rep != enum.SuccessReply {
+		stream.Close()
+		util.PrintLog(t.Config.Verbose, "[tcp] server failed to connect %v:%v with reply %v", host, port, rep)
+		t.reply(conn, rep)
 		return
 	}
-	resp(conn, enum.SuccessReply)
-	go t.toServer(stream, conn)
-	t.toClient(stream, conn)
+	counter.IncrWrittenBytes(len(first))
+	t.reply(conn, enum.SuccessReply)
+	go t.toServer(stream, conn, codec)
+	t.toClient(stream, conn, codec)
+}
+
+// reply replies the socks5 client unless it was replied at once in optimistic mode
+func (t *TCPProxy) reply(conn net.Conn, rep uint8) {
+	if !t.Config.Optimistic {
+		resp(conn, rep)
+	}
+}
+
+// readFirst reads the first payload the client sends within a short time
+func readFirst(conn net.Conn) []byte {
+	conn.SetReadDeadline(time.Now().Add(firstDataTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	b := make([]byte, MaxDataSize)
+	n, _ := conn.Read(b)
+	return b[:n]
 }
 
 // toServer is a goroutine to copy data from client to server
-func (t *TCPProxy) toServer(stream io.ReadWriteCloser, tcpconn net.Conn) {
+func (t *TCPProxy) toServer(stream io.ReadWriteCloser, tcpconn net.Conn, codec *Codec) {
 	defer stream.Close()
 	defer tcpconn.Close()
 	buffer := pool.BytePool.Get()
@@ -87,12 +96,9 @@ func (t *TCPProxy) toServer(stream io.ReadWriteCloser, tcpconn net.Conn) {
 		if err != nil {
 			break
 		}
-		b := buffer[:n]
-		if t.Config.Obfs {
-			b = cipher.XOR(b)
-		}
-		if t.Config.Compress {
-			b = snappy.Encode(nil, b)
+		b, err := codec.Encode(buffer[:n])
+		if err != nil {
+			break
 		}
 		_, err = stream.Write(b)
 		if err != nil {
@@ -103,32 +109,26 @@ func (t *TCPProxy) toServer(stream io.ReadWriteCloser, tcpconn net.Conn) {
 }
 
 // toClient is a goroutine to copy data from server to client
-func (t *TCPProxy) toClient(stream io.ReadWriteCloser, tcpconn net.Conn) {
+func (t *TCPProxy) toClient(stream io.ReadWriteCloser, tcpconn net.Conn, codec *Codec) {
 	defer stream.Close()
 	defer tcpconn.Close()
 	buffer := pool.BytePool.Get()
 	defer pool.BytePool.Put(buffer)
 	for {
-		n, err := stream.Read(buffer)
+		b, err := codec.Decode(stream, buffer)
 		if err != nil {
-			break
-		}
-		b := buffer[:n]
-		if t.Config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
+			if errors.Is(err, ErrInvalidFrame) {
+				log.Printf("[tcp] %v from server, reset stream", err)
+			} else if err != io.EOF && err != io.ErrClosedPipe {
 				util.PrintLog(t.Config.Verbose, "failed to decode:%v", err)
-				break
 			}
-		}
-		if t.Config.Obfs {
-			b = cipher.XOR(b)
+			break
 		}
 		_, err = tcpconn.Write(b)
 		if err != nil {
 			break
 		}
-		counter.IncrReadBytes(n)
+		counter.IncrReadBytes(len(b))
 	}
 }
 
@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"crypto/subtle"
+	"io"
 	"log"
 	"net"
 
@@ -16,11 +18,13 @@ type TCPServer struct {
 	Uproxy   *UDPProxy
 	UDPConn  *net.UDPConn
 	Listener net.Listener
+	accounts map[string]string
 }
 
 // Start starts the tcp server
 func (t *TCPServer) Start() {
 	log.Printf("opensocks [tcp] client started on %s", t.Config.LocalAddr)
+	t.accounts = t.Config.LocalAccounts()
 	var err error
 	t.Listener, err = net.Listen("tcp", t.Config.LocalAddr)
 	if err != nil {
@@ -37,28 +41,99 @@ func (t *TCPServer) Start() {
 
 // handler handles the tcp connection
 func (t *TCPServer) handler(tcpConn net.Conn, udpConn *net.UDPConn) {
-	if !t.checkVersion(tcpConn) {
+	methods, ok := t.checkVersion(tcpConn)
+	if !ok {
+		tcpConn.Close()
+		return
+	}
+	method := t.selectMethod(methods)
+	respMethod(tcpConn, method)
+	switch method {
+	case enum.NoAuth:
+	case enum.UserPassAuth:
+		if !t.auth(tcpConn) {
+			tcpConn.Close()
+			return
+		}
+	default:
 		tcpConn.Close()
 		return
 	}
-	//no auth
-	respNoAuth(tcpConn)
 	t.cmd(tcpConn, udpConn)
 }
 
-// checkVersion checks the version
-func (t *TCPServer) checkVersion(tcpConn net.Conn) bool {
-	buf := pool.BytePool.Get()
-	defer pool.BytePool.Put(buf)
-	n, err := tcpConn.Read(buf[0:])
-	if err != nil || n == 0 {
-		return false
+// checkVersion checks the version and returns the offered methods
+func (t *TCPServer) checkVersion(tcpConn net.Conn) ([]byte, bool) {
+	/**
+	  +----+----------+----------+
+	  |VER | NMETHODS | METHODS  |
+	  +----+----------+----------+
+	  | 1  |    1     | 1 to 255 |
+	  +----+----------+----------+
+	*/
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(tcpConn, header); err != nil {
+		return nil, false
 	}
-	b := buf[0:n]
-	if b[0] != enum.Socks5Version {
+	if header[0] != enum.Socks5Version {
 		resp(tcpConn, enum.ConnectionRefused)
+		return nil, false
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(tcpConn, methods); err != nil {
+		return nil, false
+	}
+	return methods, true
+}
+
+// selectMethod selects the auth method from the offered methods
+func (t *TCPServer) selectMethod(methods []byte) byte {
+	want := enum.NoAuth
+	if len(t.accounts) > 0 {
+		want = enum.UserPassAuth
+	}
+	for _, m := range methods {
+		if m == want {
+			return want
+		}
+	}
+	return enum.NoAcceptable
+}
+
+// auth handles the username/password auth
+func (t *TCPServer) auth(tcpConn net.Conn) bool {
+	/**
+	  +----+------+----------+------+----------+
+	  |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	  +----+------+----------+------+----------+
+	  | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	  +----+------+----------+------+----------+
+	*/
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(tcpConn, header); err != nil {
+		return false
+	}
+	if header[0] != enum.UserAuthVersion {
+		respAuth(tcpConn, enum.AuthFailure)
+		return false
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(tcpConn, username); err != nil {
 		return false
 	}
+	if _, err := io.ReadFull(tcpConn, header[:1]); err != nil {
+		return false
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(tcpConn, password); err != nil {
+		return false
+	}
+	if !checkAccount(t.accounts, string(username), string(password)) {
+		log.Printf("[tcp] failed to auth user %s from %v", username, tcpConn.RemoteAddr())
+		respAuth(tcpConn, enum.AuthFailure)
+		return false
+	}
+	respAuth(tcpConn, enum.AuthSuccess)
 	return true
 }
 
@@ -86,3 +161,9 @@ func (t *TCPServer) cmd(tcpConn net.Conn, udpConn *net.UDPConn) {
 		return
 	}
 }
+
+// checkAccount checks the username and password in constant time
+func checkAccount(accounts map[string]string, username string, password string) bool {
+	expected, ok := accounts[username]
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
@@ -10,6 +10,7 @@ import (
 // The UDPProxy struct
 type UDPProxy struct {
 	Config config.Config
+	Server *UDPServer
 }
 
 // Proxy handles the udp connection
@@ -17,6 +18,12 @@ func (u *UDPProxy) Proxy(tcpConn net.Conn, udpConn *net.UDPConn) {
 	defer tcpConn.Close()
 	udpAddr, _ := net.ResolveUDPAddr("udp", udpConn.LocalAddr().String())
 	respSuccess(tcpConn, udpAddr.IP.To4(), udpAddr.Port)
+	// allow the udp packets of the associated client
+	if u.Server != nil {
+		ip := tcpConn.RemoteAddr().(*net.TCPAddr).IP
+		u.Server.associate(ip)
+		defer u.Server.release(ip)
+	}
 	// keep tcp conn alive
 	done := make(chan bool)
 	go u.keepTCPAlive(tcpConn.(*net.TCPConn), done)
@@ -2,34 +2,45 @@ package proxy
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"strconv"
 	"sync"
 
-	"github.com/golang/snappy"
-	"github.com/net-byte/opensocks/common/cipher"
 	"github.com/net-byte/opensocks/common/enum"
 	"github.com/net-byte/opensocks/common/pool"
 	"github.com/net-byte/opensocks/common/util"
 	"github.com/net-byte/opensocks/config"
 	"github.com/net-byte/opensocks/counter"
-	"github.com/xtaci/smux"
 )
 
+// udpQueueSize is the max number of the packets queued by a flow, the packets over it are dropped
+const udpQueueSize = 64
+
 // The UDP server struct
 type UDPServer struct {
 	UDPConn   *net.UDPConn
 	Config    config.Config
-	headerMap sync.Map
-	streamMap sync.Map
-	Session   *smux.Session
-	Lock      sync.Mutex
+	flows     sync.Map
+	Pool      *SessionPool
+	auth      bool
+	clients   map[string]int
+	clientsMu sync.Mutex
+}
+
+// The udpFlow struct is the stream of a client address, its packets are queued until the stream is ready
+type udpFlow struct {
+	header  []byte
+	packets chan []byte
+	done    chan struct{}
 }
 
 // Start the UDP server
 func (u *UDPServer) Start() *net.UDPConn {
+	u.auth = len(u.Config.LocalAccounts()) > 0
+	u.clients = make(map[string]int)
 	udpAddr, _ := net.ResolveUDPAddr("udp", u.Config.LocalAddr)
 	var err error
 	u.UDPConn, err = net.ListenUDP("udp", udpAddr)
@@ -51,98 +62,127 @@ func (u *UDPServer) toServer() {
 		if err != nil {
 			break
 		}
+		if u.auth && !u.associated(cliAddr.IP) {
+			continue
+		}
 		b := buf[:n]
 		dstAddr, header, data := u.getAddr(b)
 		if dstAddr == nil || header == nil || data == nil {
 			continue
 		}
 		key := cliAddr.String()
-		var stream io.ReadWriteCloser
-		if value, ok := u.streamMap.Load(key); !ok {
-			u.Lock.Lock()
-			if u.Session == nil {
-				var err error
-				wsconn := connectServer(u.Config)
-				if wsconn == nil {
-					u.Lock.Unlock()
-					continue
-				}
-				smuxConfig := smux.DefaultConfig()
-				smuxConfig.Version = enum.SmuxVer
-				smuxConfig.MaxReceiveBuffer = enum.SmuxBuf
-				smuxConfig.MaxStreamBuffer = enum.StreamBuf
-				u.Session, err = smux.Client(wsconn, smuxConfig)
-				if err != nil || u.Session == nil {
-					log.Println(err)
-					u.Lock.Unlock()
-					continue
-				}
+		value, ok := u.flows.Load(key)
+		if !ok {
+			flow := &udpFlow{
+				header:  bytes.Clone(header),
+				packets: make(chan []byte, udpQueueSize),
+				done:    make(chan struct{}),
 			}
-			u.Lock.Unlock()
-			stream, err = u.Session.Open()
+			u.flows.Store(key, flow)
+			go u.open(key, flow, cliAddr, dstAddr)
+			value = flow
+		}
+		select {
+		case value.(*udpFlow).packets <- bytes.Clone(data):
+		default:
+			util.PrintLog(u.Config.Verbose, "[udp] dropped a packet to %v, the stream is busy", dstAddr)
+		}
+	}
+}
+
+// open opens the stream of the flow and writes its packets, the read loop never waits on it
+func (u *UDPServer) open(key string, flow *udpFlow, cliAddr, dstAddr *net.UDPAddr) {
+	stream, session, err := u.Pool.OpenStream()
+	if err != nil {
+		u.flows.CompareAndDelete(key, flow)
+		log.Printf("[udp] failed to open session %v", err)
+		return
+	}
+	codec, rep, err := handshake(stream, "udp", dstAddr.IP.String(), strconv.Itoa(dstAddr.Port), nil, u.Config, session.Secret)
+	if err != nil {
+		stream.Close()
+		u.flows.CompareAndDelete(key, flow)
+		if sessionFailed(session, err) {
+			u.Pool.Drop(session, err)
+		}
+		log.Printf("[udp] failed to handshake %v", err)
+		return
+	}
+	if rep != enum.SuccessReply {
+		stream.Close()
+		u.flows.CompareAndDelete(key, flow)
+		util.PrintLog(u.Config.Verbose, "[udp] server failed to connect %v with reply %v", dstAddr, rep)
+		return
+	}
+	go u.toClient(stream, key, flow, cliAddr, codec)
+	for {
+		select {
+		case <-flow.done:
+			return
+		case data := <-flow.packets:
+			b, err := codec.Encode(data)
 			if err != nil {
-				u.Session = nil
-				util.PrintLog(u.Config.Verbose, "failed to open session:%v", err)
 				continue
 			}
-			ok := handshake(stream, "udp", dstAddr.IP.String(), strconv.Itoa(dstAddr.Port), u.Config.Key, u.Config.Obfs)
-			if !ok {
-				u.Session = nil
-				log.Println("[udp] failed to handshake")
-				continue
+			if _, err = stream.Write(b); err != nil {
+				// toClient ends the flow on the closed stream
+				stream.Close()
+				return
 			}
-			u.streamMap.Store(key, stream)
-			u.headerMap.Store(key, header)
-			go u.toClient(stream, cliAddr)
-		} else {
-			stream = value.(io.ReadWriteCloser)
-		}
-		if u.Config.Obfs {
-			data = cipher.XOR(data)
-		}
-		if u.Config.Compress {
-			data = snappy.Encode(nil, data)
+			counter.IncrWrittenBytes(len(data))
 		}
-		stream.Write(data)
-		counter.IncrWrittenBytes(n)
 	}
 }
 
 // toClient handle the udp packet from server
-func (u *UDPServer) toClient(stream io.ReadWriteCloser, cliAddr *net.UDPAddr) {
-	key := cliAddr.String()
+func (u *UDPServer) toClient(stream io.ReadWriteCloser, key string, flow *udpFlow, cliAddr *net.UDPAddr, codec *Codec) {
 	buffer := pool.BytePool.Get()
 	defer pool.BytePool.Put(buffer)
 	defer stream.Close()
+	defer close(flow.done)
+	defer u.flows.CompareAndDelete(key, flow)
 	for {
-		n, err := stream.Read(buffer)
+		b, err := codec.Decode(stream, buffer)
 		if err != nil {
+			if errors.Is(err, ErrInvalidFrame) {
+				log.Printf("[udp] %v from server, reset stream", err)
+			} else if err != io.EOF && err != io.ErrClosedPipe {
+				util.PrintLog(u.Config.Verbose, "failed to decode:%v", err)
+			}
 			break
 		}
-		if header, ok := u.headerMap.Load(key); ok {
-			b := buffer[:n]
-			if u.Config.Compress {
-				b, err = snappy.Decode(nil, b)
-				if err != nil {
-					util.PrintLog(u.Config.Verbose, "failed to decode:%v", err)
-					break
-				}
-			}
-			if u.Config.Obfs {
-				b = cipher.XOR(b)
-			}
-			var data bytes.Buffer
-			data.Write(header.([]byte))
-			data.Write(b)
-			_, err = u.UDPConn.WriteToUDP(data.Bytes(), cliAddr)
-			if err != nil {
-				break
-			}
-			counter.IncrReadBytes(n)
+		var data bytes.Buffer
+		data.Write(flow.header)
+		data.Write(b)
+		_, err = u.UDPConn.WriteToUDP(data.Bytes(), cliAddr)
+		if err != nil {
+			break
 		}
+		counter.IncrReadBytes(len(b))
+	}
+}
+
+// associate allows the udp packets from the ip
+func (u *UDPServer) associate(ip net.IP) {
+	u.clientsMu.Lock()
+	defer u.clientsMu.Unlock()
+	u.clients[ip.String()]++
+}
+
+// release removes an association of the ip
+func (u *UDPServer) release(ip net.IP) {
+	u.clientsMu.Lock()
+	defer u.clientsMu.Unlock()
+	if u.clients[ip.String()]--; u.clients[ip.String()] <= 0 {
+		delete(u.clients, ip.String())
 	}
-	u.headerMap.Delete(key)
-	u.streamMap.Delete(key)
+}
+
+// associated returns true if the ip has an associated tcp connection
+func (u *UDPServer) associated(ip net.IP) bool {
+	u.clientsMu.Lock()
+	defer u.clientsMu.Unlock()
+	return u.clients[ip.String()] > 0
 }
 
 // getAddr get the dst addr and header from the packet
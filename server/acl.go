@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/config"
+)
+
+// _reservedNets are the ranges blocked by default besides loopback, link-local and private
+var _reservedNets = mustParseCIDRs([]string{"0.0.0.0/8", "100.64.0.0/10"})
+
+// The policy struct decides which destinations the server may dial
+type policy struct {
+	allowNets    []*net.IPNet
+	denyNets     []*net.IPNet
+	allowPorts   []portRange
+	denyPorts    []portRange
+	allowDomains []string
+	denyDomains  []string
+	allowPrivate bool
+}
+
+type portRange struct {
+	from int
+	to   int
+}
+
+// newPolicy creates the policy from the acl
+func newPolicy(acl config.ACL) (*policy, error) {
+	p := &policy{allowDomains: acl.AllowDomains, denyDomains: acl.DenyDomains, allowPrivate: acl.AllowPrivate}
+	var err error
+	if p.allowNets, err = parseCIDRs(acl.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if p.denyNets, err = parseCIDRs(acl.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	if p.allowPorts, err = parsePorts(acl.AllowPorts); err != nil {
+		return nil, err
+	}
+	if p.denyPorts, err = parsePorts(acl.DenyPorts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// resolve checks the destination and returns the allowed addresses to dial
+func (p *policy) resolve(host string, port string) ([]string, error) {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, errors.New("invalid port")
+	}
+	if matchPort(p.denyPorts, portNum) {
+		return nil, errors.New("port denied")
+	}
+	if len(p.allowPorts) > 0 && !matchPort(p.allowPorts, portNum) {
+		return nil, errors.New("port not allowed")
+	}
+	domainAllowed := false
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if matchDomain(p.denyDomains, host) {
+			return nil, errors.New("domain denied")
+		}
+		domainAllowed = matchDomain(p.allowDomains, host)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(enum.Timeout)*time.Second)
+		defer cancel()
+		if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+	var addrs []string
+	for _, ip := range ips {
+		if err = p.checkIP(ip, domainAllowed); err == nil {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// checkIP checks the ip, the allowed domain skips the default block
+func (p *policy) checkIP(ip net.IP, domainAllowed bool) error {
+	if matchNet(p.denyNets, ip) {
+		return fmt.Errorf("%v denied", ip)
+	}
+	if matchNet(p.allowNets, ip) || domainAllowed || p.allowPrivate {
+		return nil
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() ||
+		ip.IsUnspecified() || ip.IsMulticast() || matchNet(_reservedNets, ip) {
+		return fmt.Errorf("%v is a reserved address", ip)
+	}
+	return nil
+}
+
+func matchNet(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain matches the host with the patterns like example.com or *.example.com
+func matchDomain(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// parsePorts parses the ports like 443 or 8000-9000
+func parsePorts(ports []string) ([]portRange, error) {
+	var ranges []portRange
+	for _, port := range ports {
+		from, to, found := strings.Cut(port, "-")
+		var r portRange
+		var err error
+		if r.from, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+			return nil, fmt.Errorf("invalid port %s", port)
+		}
+		r.to = r.from
+		if found {
+			if r.to, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+				return nil, fmt.Errorf("invalid port %s", port)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/common/util"
+	"github.com/net-byte/opensocks/config"
+	"github.com/net-byte/opensocks/transport"
+)
+
+// hasFallback returns true if the failed handshakes are spliced to the fallback address
+func hasFallback(config config.Config) bool {
+	if config.Fallback == "" {
+		return false
+	}
+	t, err := transport.Get(config.Protocol)
+	if err != nil {
+		return false
+	}
+	f, ok := t.(transport.Fallback)
+	return ok && f.Fallback()
+}
+
+// fallback splices the conn to the fallback address, replaying the bytes already read
+func fallback(config config.Config, conn net.Conn, head []byte) {
+	fconn, err := net.DialTimeout("tcp", config.Fallback, time.Duration(enum.Timeout)*time.Second)
+	if err != nil {
+		log.Printf("[server] failed to dial fallback %s %v", config.Fallback, err)
+		return
+	}
+	defer fconn.Close()
+	util.PrintLog(config.Verbose, "[server] fallback %v to %s", conn.RemoteAddr(), config.Fallback)
+	if _, err = fconn.Write(head); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(fconn, conn)
+		fconn.Close()
+	}()
+	io.Copy(conn, fconn)
+}
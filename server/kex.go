@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/net-byte/opensocks/common/cipher"
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/config"
+	"github.com/net-byte/opensocks/counter"
+	"github.com/net-byte/opensocks/proto"
+)
+
+// readHello reads the hello of the client, the bytes which cannot start a hello are rejected at once
+// and the rest of a partial hello must arrive within a random delay
+func readHello(config config.Config, conn net.Conn) ([]byte, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	b := make([]byte, proto.HelloSize)
+	conn.SetReadDeadline(time.Now().Add(time.Duration(enum.Timeout) * time.Second))
+	n, err := conn.Read(b)
+	conn.SetReadDeadline(time.Now().Add(time.Duration(100+rand.Intn(900)) * time.Millisecond))
+	for err == nil && n < len(b) {
+		if !helloPrefix(config, b[:n]) {
+			return b[:n], errors.New("invalid hello")
+		}
+		var m int
+		m, err = conn.Read(b[n:])
+		n += m
+	}
+	return b[:n], err
+}
+
+// helloPrefix reports whether the bytes may start a hello, the timestamp must be within the clock skew once read
+func helloPrefix(config config.Config, b []byte) bool {
+	if len(b) < proto.KeySize+8 {
+		return true
+	}
+	ts := int64(binary.BigEndian.Uint64(b[proto.KeySize:]))
+	now, skew := time.Now().Unix(), int64(config.Skew)
+	return ts >= now-skew && ts <= now+skew
+}
+
+// exchange verifies the hello of the client and exchanges the session keys
+func exchange(config config.Config, conn net.Conn, b []byte) (secure net.Conn, secret []byte, user config.User, err error) {
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(enum.Timeout) * time.Second))
+	defer conn.SetWriteDeadline(time.Time{})
+	var hello proto.Hello
+	if err = hello.UnmarshalBinary(b); err != nil {
+		return nil, nil, user, err
+	}
+	user, valid := _users.match(func(key string) bool {
+		return hmac.Equal(hello.MAC, cipher.MAC(key, hello.Signed()...))
+	})
+	if user.Name == "" {
+		return nil, nil, user, errors.New("invalid hello")
+	}
+	if !valid {
+		return nil, nil, user, errors.New("disabled or expired user")
+	}
+	now := time.Now().Unix()
+	skew := int64(config.Skew)
+	if hello.Timestamp < now-skew || hello.Timestamp > now+skew {
+		return nil, nil, user, errors.New("hello timestamp out of window")
+	}
+	if err := _replayCache.check("hello:"+hex.EncodeToString(hello.Nonce), now, hello.Timestamp+skew); err != nil {
+		if errors.Is(err, errReplayed) {
+			counter.IncrRejectedReplays()
+		}
+		return nil, nil, user, err
+	}
+	priv, err := cipher.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, user, err
+	}
+	reply := proto.HelloReply{PublicKey: priv.PublicKey().Bytes()}
+	reply.MAC = cipher.MAC(user.Key, reply.Signed(b)...)
+	rb, err := reply.MarshalBinary()
+	if err != nil {
+		return nil, nil, user, err
+	}
+	if secret, err = cipher.SessionSecret(priv, hello.PublicKey, append(b, reply.PublicKey...)); err != nil {
+		return nil, nil, user, err
+	}
+	if _, err = conn.Write(rb); err != nil {
+		return nil, nil, user, err
+	}
+	if secure, err = cipher.NewConn(conn, secret, true, config.Padding); err != nil {
+		return nil, nil, user, err
+	}
+	return secure, secret, user, nil
+}
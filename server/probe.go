@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/config"
+)
+
+// The probe guard struct counts the failed handshakes per ip in a time window
+type probeGuard struct {
+	lock     sync.Mutex
+	window   int64
+	limit    int
+	failures map[string]*probeRecord
+}
+
+type probeRecord struct {
+	count int
+	since int64
+}
+
+// newProbeGuard creates a probe guard allowing limit failures per window seconds
+func newProbeGuard(limit int, window int64) *probeGuard {
+	return &probeGuard{window: window, limit: limit, failures: make(map[string]*probeRecord)}
+}
+
+// blocked returns true if the ip exceeded the failed handshakes allowed
+func (p *probeGuard) blocked(ip string, now int64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r, ok := p.failures[ip]
+	return ok && r.since+p.window > now && r.count >= p.limit
+}
+
+// fail records a failed handshake of the ip
+func (p *probeGuard) fail(ip string, now int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r, ok := p.failures[ip]
+	if !ok || r.since+p.window <= now {
+		if len(p.failures) >= enum.ReplaySize {
+			p.prune(now)
+		}
+		r = &probeRecord{since: now}
+		p.failures[ip] = r
+	}
+	r.count++
+}
+
+// prune drops the expired records
+func (p *probeGuard) prune(now int64) {
+	for ip, r := range p.failures {
+		if r.since+p.window <= now {
+			delete(p.failures, ip)
+		}
+	}
+}
+
+// reject handles the conn failing the handshake, either by the fallback or as a slow peer
+func reject(config config.Config, conn net.Conn, head []byte) {
+	if hasFallback(config) {
+		fallback(config, conn, head)
+		return
+	}
+	_probeGuard.fail(remoteIP(conn.RemoteAddr()), time.Now().Unix())
+	stall(conn)
+}
+
+// stall reads to a random length and holds the conn for a random delay before closing
+func stall(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Duration(1000+rand.Intn(enum.Timeout*100)) * time.Millisecond))
+	io.CopyN(io.Discard, conn, int64(rand.Intn(enum.BufferSize)))
+	time.Sleep(time.Duration(rand.Intn(enum.Timeout*50)) * time.Millisecond)
+}
+
+// remoteIP returns the ip of the remote address
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
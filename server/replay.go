@@ -0,0 +1,64 @@
+package server
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+)
+
+var (
+	errReplayed   = errors.New("replayed nonce")
+	errReplayFull = errors.New("replay cache full of valid nonces")
+)
+
+// The replay cache struct remembers the handshake nonces until they expire
+type replayCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]struct{}
+	expiry  replayHeap
+}
+
+type replayEntry struct {
+	key    string
+	expiry int64
+}
+
+// The replay heap type orders the nonces by expiry
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int           { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].expiry < h[j].expiry }
+func (h replayHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x any)        { *h = append(*h, x.(replayEntry)) }
+func (h *replayHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// newReplayCache creates a replay cache holding at most size nonces
+func newReplayCache(size int) *replayCache {
+	return &replayCache{size: size, entries: make(map[string]struct{})}
+}
+
+// check records the nonce, it returns errReplayed if the nonce was already seen
+// and errReplayFull if the cache is full of the nonces not expired yet
+func (c *replayCache) check(key string, now int64, expiry int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// drop the expired nonces only, a valid nonce evicted could be replayed
+	for c.expiry.Len() > 0 && c.expiry[0].expiry < now {
+		delete(c.entries, heap.Pop(&c.expiry).(replayEntry).key)
+	}
+	if _, ok := c.entries[key]; ok {
+		return errReplayed
+	}
+	if len(c.entries) >= c.size {
+		return errReplayFull
+	}
+	c.entries[key] = struct{}{}
+	heap.Push(&c.expiry, replayEntry{key: key, expiry: expiry})
+	return nil
+}
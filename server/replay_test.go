@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReplayCacheFull(t *testing.T) {
+	c := newReplayCache(2)
+	if err := c.check("a", 100, 130); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.check("b", 100, 110); err != nil {
+		t.Fatal(err)
+	}
+	// full of valid nonces, the oldest is not evicted to make room
+	if err := c.check("c", 105, 135); !errors.Is(err, errReplayFull) {
+		t.Fatalf("got %v, want a full cache", err)
+	}
+	if err := c.check("a", 105, 135); !errors.Is(err, errReplayed) {
+		t.Fatalf("got %v, want a replay", err)
+	}
+	// b expired first though inserted after a, its room is reused while a is still remembered
+	if err := c.check("c", 111, 141); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.check("a", 120, 150); !errors.Is(err, errReplayed) {
+		t.Fatalf("got %v, want a replay", err)
+	}
+	if err := c.check("b", 131, 161); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,8 +2,8 @@ package server
 
 import (
 	"bufio"
-	"context"
-	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -11,10 +11,9 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gobwas/ws"
-	"github.com/golang/snappy"
 	"github.com/net-byte/opensocks/common/cipher"
 	"github.com/net-byte/opensocks/common/enum"
 	"github.com/net-byte/opensocks/common/pool"
@@ -23,9 +22,8 @@ import (
 	"github.com/net-byte/opensocks/counter"
 	"github.com/net-byte/opensocks/proto"
 	"github.com/net-byte/opensocks/proxy"
-	"github.com/xtaci/kcp-go/v5"
+	"github.com/net-byte/opensocks/transport"
 	"github.com/xtaci/smux"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 var _defaultPage = []byte(`
@@ -39,65 +37,72 @@ var _defaultPage = []byte(`
 </body>
 </html>`)
 
-var _wsServer http.Server
-var _tcpListener net.Listener
-var _kcpListener *kcp.Listener
-var _serverType string
+var _listener net.Listener
+var _replayCache = newReplayCache(enum.ReplaySize)
+var _probeGuard = newProbeGuard(enum.ProbeLimit, int64(enum.ProbeTime))
+var _users userTable
+var _policy *policy
 
 // Start starts the server
 func Start(config config.Config) {
 	util.PrintStats(config.Verbose, config.ServerMode)
-	switch config.Protocol {
-	case "kcp":
-		_serverType = "kcp"
-		startKCPServer(config)
-	case "tcp":
-		_serverType = "tcp"
-		startTCPServer(config)
-	default:
-		_serverType = "ws"
-		startWSServer(config)
+	if err := _users.load(config); err != nil {
+		log.Panicf("[server] failed to load users %v", err)
+	}
+	go _users.watch(config)
+	acl, err := config.LoadACL()
+	if err != nil {
+		log.Panicf("[server] failed to load acl %v", err)
+	}
+	if _policy, err = newPolicy(acl); err != nil {
+		log.Panicf("[server] invalid acl %v", err)
+	}
+	if err := transport.Check(config); err != nil {
+		log.Panicf("[server] %v", err)
+	}
+	t, err := transport.Get(config.Protocol)
+	if err != nil {
+		log.Panicf("[server] %v", err)
+	}
+	hooks := transport.Hooks{
+		Blocked: func(ip string) bool {
+			return _probeGuard.blocked(ip, time.Now().Unix())
+		},
+		Failed: func(ip string) {
+			_probeGuard.fail(ip, time.Now().Unix())
+		},
+		Handler: newHTTPHandler(),
+	}
+	if _listener, err = t.Listen(config, hooks); err != nil {
+		log.Panicf("[server] failed to listen on %s %v", config.ServerAddr, err)
+	}
+	log.Printf("opensocks %s server started on %s", config.Protocol, config.ServerAddr)
+	for {
+		conn, err := _listener.Accept()
+		if err != nil {
+			break
+		}
+		go muxHandler(conn, config)
 	}
 }
 
-// Stop starts the server
+// Stop stops the server
 func Stop() {
-	switch _serverType {
-	case "kcp":
-		if err := _kcpListener.Close(); err != nil {
-			log.Printf("failed to shutdown kcp server: %v", err)
-		}
-	case "tcp":
-		if err := _tcpListener.Close(); err != nil {
-			log.Printf("failed to shutdown tcp server: %v", err)
-		}
-	default:
-		if err := _wsServer.Shutdown(context.Background()); err != nil {
-			log.Printf("failed to shutdown ws server: %v", err)
-		}
+	if _listener == nil {
+		return
+	}
+	if err := _listener.Close(); err != nil {
+		log.Printf("failed to shutdown server: %v", err)
 	}
 }
 
-func startWSServer(config config.Config) {
-	http.HandleFunc(enum.WSPath, func(w http.ResponseWriter, r *http.Request) {
-		conn, _, _, err := ws.UpgradeHTTP(r, w)
-		if err != nil {
-			log.Printf("[server] failed to upgrade http %v", err)
-			return
-		}
-		muxHandler(conn, config)
-	})
-
-	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(200)
-		w.Header().Set("Content-Type", "text/html")
-		w.Header().Set("Content-Length", strconv.Itoa(len(_defaultPage)))
-		w.Header().Set("Connection", " keep-alive")
-		w.Header().Set("Accept-Ranges", "bytes")
-		w.Write(_defaultPage)
+// newHTTPHandler returns the handler of the http requests other than the tunnels
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		writeDefaultPage(w)
 	})
-
-	http.HandleFunc("/ip", func(w http.ResponseWriter, req *http.Request) {
+	mux.HandleFunc("/ip", func(w http.ResponseWriter, req *http.Request) {
 		ip := req.Header.Get("X-Forwarded-For")
 		if ip == "" {
 			ip = strings.Split(req.RemoteAddr, ":")[0]
@@ -105,59 +110,58 @@ func startWSServer(config config.Config) {
 		resp := fmt.Sprintf("%v", ip)
 		io.WriteString(w, resp)
 	})
-
-	http.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
-		io.WriteString(w, counter.PrintServerBytes())
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, counter.PrintServerStats())
+		if users := counter.PrintUserStats(); users != "" {
+			io.WriteString(w, "\n"+users)
+		}
 	})
-
-	log.Printf("opensocks ws server started on %s", config.ServerAddr)
-	_wsServer = http.Server{
-		Addr: config.ServerAddr,
-	}
-	_wsServer.ListenAndServe()
+	return mux
 }
 
-func startKCPServer(config config.Config) {
-	key := pbkdf2.Key([]byte(config.Key), []byte("opensocks@2022"), 1024, 32, sha1.New)
-	block, _ := kcp.NewAESBlockCrypt(key)
-	var err error
-	if _kcpListener, err = kcp.ListenWithOptions(config.ServerAddr, block, 10, 3); err == nil {
-		log.Printf("opensocks kcp server started on %s", config.ServerAddr)
-		for {
-			conn, err := _kcpListener.AcceptKCP()
-			if err != nil {
-				break
-			}
-			conn.SetWindowSize(enum.SndWnd, enum.RcvWnd)
-			if err := conn.SetReadBuffer(enum.SockBuf); err != nil {
-				log.Println("[server] failed to set read buffer:", err)
-			}
-			go muxHandler(conn, config)
-		}
-	}
+func writeDefaultPage(w http.ResponseWriter) {
+	w.WriteHeader(200)
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(len(_defaultPage)))
+	w.Header().Set("Connection", " keep-alive")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Write(_defaultPage)
 }
 
-func startTCPServer(config config.Config) {
-	var err error
-	if _tcpListener, err = net.Listen("tcp", config.ServerAddr); err == nil {
-		log.Printf("opensocks tcp server started on %s", config.ServerAddr)
+func muxHandler(w net.Conn, config config.Config) {
+	defer w.Close()
+	// drop the repeated probes silently
+	if !hasFallback(config) && _probeGuard.blocked(remoteIP(w.RemoteAddr()), time.Now().Unix()) {
+		return
+	}
+	// the client certificate identifies the device
+	device, err := util.PeerIdentity(w)
+	if err != nil {
+		util.PrintLog(config.Verbose, "[server] handshake failed from %v %v", w.RemoteAddr(), err)
+		_probeGuard.fail(remoteIP(w.RemoteAddr()), time.Now().Unix())
+		return
+	}
+	muxer, native := w.(transport.Muxer)
+	secure, secret, user, ok := authenticate(config, w, device)
+	if !ok {
+		return
+	}
+	if native {
 		for {
-			conn, err := _tcpListener.Accept()
+			stream, err := muxer.AcceptStream()
 			if err != nil {
+				util.PrintLog(config.Verbose, "[server] failed to accept steam %v", err)
 				break
 			}
-			go muxHandler(conn, config)
+			go func() {
+				if secure, err := acceptNative(config, secret, stream); err == nil {
+					streamHandler(config, user, secret, w, secure)
+				}
+			}()
 		}
+		return
 	}
-}
-
-func muxHandler(w net.Conn, config config.Config) {
-	defer w.Close()
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.Version = enum.SmuxVer
-	smuxConfig.MaxReceiveBuffer = enum.SmuxBuf
-	smuxConfig.MaxStreamBuffer = enum.StreamBuf
-	session, err := smux.Server(w, smuxConfig)
+	session, err := smux.Server(secure, proxy.SmuxConfig(config))
 	if err != nil {
 		log.Printf("[server] failed to initialise yamux session: %s", err)
 		return
@@ -169,53 +173,209 @@ func muxHandler(w net.Conn, config config.Config) {
 			util.PrintLog(config.Verbose, "[server] failed to accept steam %v", err)
 			break
 		}
-		go func() {
-			defer stream.Close()
-			reader := bufio.NewReader(stream)
-			// handshake
-			ok, req := handshake(config, reader)
-			if !ok {
-				return
-			}
-			util.PrintLog(config.Verbose, "[server] dial to server %v", req.Network, req.Host, req.Port)
-			conn, err := net.DialTimeout(req.Network, net.JoinHostPort(req.Host, req.Port), time.Duration(enum.Timeout)*time.Second)
-			if err != nil {
-				util.PrintLog(config.Verbose, "[server] failed to dial server %v", err)
-				return
-			}
-			// forward data
-			go toServer(config, reader, conn)
-			toClient(config, stream, conn)
-		}()
+		go streamHandler(config, user, secret, session, stream)
+	}
+}
+
+// acceptNative reads the salt of the native stream and seals the stream with the keys derived from it
+func acceptNative(config config.Config, secret []byte, stream net.Conn) (net.Conn, error) {
+	salt := make([]byte, cipher.SaltSize)
+	stream.SetReadDeadline(time.Now().Add(time.Duration(enum.Timeout) * time.Second))
+	if _, err := io.ReadFull(stream, salt); err != nil {
+		util.PrintLog(config.Verbose, "[server] failed to read the stream salt from %v %v", stream.RemoteAddr(), err)
+		stream.Close()
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+	secure, err := cipher.NewStreamConn(stream, secret, salt, true, config.Padding)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return secure, nil
+}
+
+// authenticate exchanges the session keys with the client, the conn failing the handshake is rejected
+func authenticate(config config.Config, w net.Conn, device string) (secure net.Conn, secret []byte, user config.User, ok bool) {
+	if u, ok := _users.lookup(device); device != "" && ok && !u.Valid(time.Now()) {
+		log.Printf("[server] [%s] rejected revoked device from %v", device, w.RemoteAddr())
+		return nil, nil, user, false
 	}
+	// exchange the session keys
+	hello, err := readHello(config, w)
+	if err != nil {
+		util.PrintLog(config.Verbose, "[server] handshake failed from %v %v", w.RemoteAddr(), err)
+		reject(config, w, hello)
+		return nil, nil, user, false
+	}
+	secure, secret, user, err = exchange(config, w, hello)
+	if err != nil {
+		if user.Name != "" {
+			log.Printf("[server] [%s] handshake failed from %v %v", user.Name, w.RemoteAddr(), err)
+		} else {
+			util.PrintLog(config.Verbose, "[server] handshake failed from %v %v", w.RemoteAddr(), err)
+		}
+		reject(config, w, hello)
+		return nil, nil, user, false
+	}
+	if device != "" {
+		user.Name = device
+	}
+	return secure, secret, user, true
+}
+
+// streamHandler serves the stream of the session, the session is closed once its user or device is revoked
+func streamHandler(config config.Config, user config.User, secret []byte, session io.Closer, stream net.Conn) {
+	defer stream.Close()
+	reader := bufio.NewReader(stream)
+	// handshake
+	req, err := handshake(config, user, stream, reader)
+	var verr *proxy.VersionError
+	if errors.As(err, &verr) {
+		log.Printf("[server] [%s] %v from %v", user.Name, err, stream.RemoteAddr())
+		writeAck(config, user, stream, req, enum.ServerFailure, 0)
+		return
+	}
+	if errors.Is(err, errRevoked) {
+		log.Printf("[server] [%s] closed the session from %v %v", user.Name, stream.RemoteAddr(), err)
+		session.Close()
+		return
+	}
+	// the session is authenticated, so the stream failing the handshake is closed without counting a probe
+	if err != nil {
+		log.Printf("[server] [%s] handshake failed from %v %v", user.Name, stream.RemoteAddr(), err)
+		return
+	}
+	// agree on the features required by both sides
+	flags := req.Required | proxy.RequiredFlags(config)
+	if unsupported := flags&^req.Supported | flags&^proxy.Flags; unsupported != 0 {
+		log.Printf("[server] [%s] unsupported flags %#x from %v", user.Name, unsupported, stream.RemoteAddr())
+		writeAck(config, user, stream, req, enum.ServerFailure, flags)
+		return
+	}
+	// reply to the pings of the client checking the session is alive
+	if req.Network == "ping" {
+		writeAck(config, user, stream, req, enum.SuccessReply, flags)
+		return
+	}
+	// check the destination policy
+	addrs, err := _policy.resolve(req.Host, strconv.Itoa(int(req.Port)))
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		util.PrintLog(config.Verbose, "[server] [%s] failed to resolve %v %v", user.Name, req.Host, err)
+		writeAck(config, user, stream, req, enum.HostUnreachable, flags)
+		return
+	}
+	if err != nil {
+		log.Printf("[server] [%s] blocked %v %v:%v %v", user.Name, req.Network, req.Host, req.Port, err)
+		writeAck(config, user, stream, req, enum.RuleFailure, flags)
+		return
+	}
+	// reply with the dial result
+	util.PrintLog(config.Verbose, "[server] [%s] dial to server %v %v:%v", user.Name, req.Network, req.Host, req.Port)
+	conn, err := dial(req.Network, addrs)
+	if err != nil {
+		util.PrintLog(config.Verbose, "[server] [%s] failed to dial server %v", user.Name, err)
+		writeAck(config, user, stream, req, dialReply(err), flags)
+		return
+	}
+	// write the first payload sent with the handshake
+	if len(req.Data) > 0 {
+		if _, err = conn.Write(req.Data); err != nil {
+			conn.Close()
+			writeAck(config, user, stream, req, enum.ServerFailure, flags)
+			return
+		}
+		counter.IncrUserReadBytes(user.Name, len(req.Data))
+	}
+	if !writeAck(config, user, stream, req, enum.SuccessReply, flags) {
+		conn.Close()
+		return
+	}
+	codec, err := proxy.NewCodec(flags, secret, req, true)
+	if err != nil {
+		util.PrintLog(config.Verbose, "[server] [%s] failed to create codec %v", user.Name, err)
+		conn.Close()
+		return
+	}
+	// forward data
+	go toServer(config, user.Name, reader, conn, codec)
+	toClient(config, user.Name, stream, conn, codec)
 }
 
-func handshake(config config.Config, reader *bufio.Reader) (bool, proxy.RequestAddr) {
-	var req proxy.RequestAddr
+func handshake(config config.Config, user config.User, stream net.Conn, reader *bufio.Reader) (req proxy.RequestAddr, err error) {
+	stream.SetReadDeadline(time.Now().Add(time.Duration(enum.Timeout) * time.Second))
+	defer stream.SetReadDeadline(time.Time{})
 	b, _, err := proto.Decode(reader)
 	if err != nil {
-		return false, req
+		return req, err
+	}
+	if err = req.UnmarshalBinary(b); err != nil {
+		return req, err
+	}
+	if !req.Verify(user.Key) {
+		return req, errors.New("invalid signature")
+	}
+	if !_users.active(user) {
+		return req, errRevoked
+	}
+	now := time.Now().Unix()
+	skew := int64(config.Skew)
+	if req.Timestamp < now-skew || req.Timestamp > now+skew {
+		return req, errors.New("timestamp out of window")
+	}
+	if err := _replayCache.check("request:"+hex.EncodeToString(req.Random), now, req.Timestamp+skew); err != nil {
+		if errors.Is(err, errReplayed) {
+			counter.IncrRejectedReplays()
+		}
+		return req, err
+	}
+	return req, nil
+}
+
+func writeAck(config config.Config, user config.User, stream net.Conn, req proxy.RequestAddr, reply uint8, flags uint8) bool {
+	data, err := proxy.NewAck(req, user.Key, reply, flags).MarshalBinary()
+	if err != nil {
+		return false
 	}
-	if config.Obfs {
-		b = cipher.XOR(b)
+	encode, err := proto.Encode(data)
+	if err != nil {
+		return false
 	}
-	if req.UnmarshalBinary(b) != nil {
-		util.PrintLog(config.Verbose, "[server] failed to decode request %v", err)
-		return false, req
+	if _, err = stream.Write(encode); err != nil {
+		util.PrintLog(config.Verbose, "[server] [%s] failed to write ack %v", user.Name, err)
+		return false
 	}
-	reqTime, _ := strconv.ParseInt(req.Timestamp, 10, 64)
-	if time.Now().Unix()-reqTime > int64(enum.Timeout) {
-		util.PrintLog(config.Verbose, "[server] timestamp expired %v", reqTime)
-		return false, req
+	return true
+}
+
+func dial(network string, addrs []string) (conn net.Conn, err error) {
+	dialer := net.Dialer{Deadline: time.Now().Add(time.Duration(enum.Timeout) * time.Second)}
+	for _, addr := range addrs {
+		if conn, err = dialer.Dial(network, addr); err == nil {
+			return conn, nil
+		}
 	}
-	if config.Key != req.Key {
-		util.PrintLog(config.Verbose, "[server] error key %s", req.Key)
-		return false, req
+	return nil, err
+}
+
+// dialReply maps the dial error to the socks5 reply
+func dialReply(err error) uint8 {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return enum.ConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return enum.HostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return enum.NetworkUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return enum.TTLExpired
 	}
-	return true, req
+	return enum.ServerFailure
 }
 
-func toClient(config config.Config, stream net.Conn, conn net.Conn) {
+func toClient(config config.Config, user string, stream net.Conn, conn net.Conn, codec *proxy.Codec) {
 	defer conn.Close()
 	buffer := pool.BytePool.Get()
 	defer pool.BytePool.Put(buffer)
@@ -224,45 +384,36 @@ func toClient(config config.Config, stream net.Conn, conn net.Conn) {
 		if err != nil {
 			break
 		}
-		b := buffer[:n]
-		if config.Obfs {
-			b = cipher.XOR(b)
-		}
-		if config.Compress {
-			b = snappy.Encode(nil, b)
+		b, err := codec.Encode(buffer[:n])
+		if err != nil {
+			break
 		}
 		_, err = stream.Write(b)
 		if err != nil {
 			break
 		}
-		counter.IncrWrittenBytes(n)
+		counter.IncrUserWrittenBytes(user, n)
 	}
 }
 
-func toServer(config config.Config, reader *bufio.Reader, conn net.Conn) {
+func toServer(config config.Config, user string, reader *bufio.Reader, conn net.Conn, codec *proxy.Codec) {
 	defer conn.Close()
 	buffer := pool.BytePool.Get()
 	defer pool.BytePool.Put(buffer)
 	for {
-		n, err := reader.Read(buffer)
+		b, err := codec.Decode(reader, buffer)
 		if err != nil {
-			break
-		}
-		b := buffer[:n]
-		if config.Compress {
-			b, err = snappy.Decode(nil, b)
-			if err != nil {
-				util.PrintLog(config.Verbose, "failed to decode:%v", err)
-				break
+			if errors.Is(err, proxy.ErrInvalidFrame) {
+				log.Printf("[server] [%s] %v from client, reset stream", user, err)
+			} else if err != io.EOF && err != io.ErrClosedPipe {
+				util.PrintLog(config.Verbose, "[server] [%s] failed to decode:%v", user, err)
 			}
-		}
-		if config.Obfs {
-			b = cipher.XOR(b)
+			break
 		}
 		_, err = conn.Write(b)
 		if err != nil {
 			break
 		}
-		counter.IncrReadBytes(int(n))
+		counter.IncrUserReadBytes(user, len(b))
 	}
 }
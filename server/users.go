@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-byte/opensocks/config"
+)
+
+// The user table struct, it can be reloaded without affecting the running streams
+type userTable struct {
+	users   atomic.Value
+	modTime time.Time
+}
+
+// load loads the users from the config and the users file
+func (t *userTable) load(config config.Config) error {
+	var modTime time.Time
+	if config.UsersFile != "" {
+		info, err := os.Stat(config.UsersFile)
+		if err != nil {
+			return err
+		}
+		modTime = info.ModTime()
+	}
+	users, err := config.LoadUsers()
+	if err != nil {
+		return err
+	}
+	t.users.Store(users)
+	t.modTime = modTime
+	return nil
+}
+
+// watch reloads the users file when it changes
+func (t *userTable) watch(config config.Config) {
+	if config.UsersFile == "" {
+		return
+	}
+	for {
+		time.Sleep(10 * time.Second)
+		info, err := os.Stat(config.UsersFile)
+		if err != nil || info.ModTime().Equal(t.modTime) {
+			continue
+		}
+		if err = t.load(config); err != nil {
+			log.Printf("[server] failed to reload users %v", err)
+			continue
+		}
+		log.Printf("[server] reloaded %d users from %s", len(t.list()), config.UsersFile)
+	}
+}
+
+// list returns the current users
+func (t *userTable) list() []config.User {
+	users, _ := t.users.Load().([]config.User)
+	return users
+}
+
+// match returns the user whose key passes the verify func and whether the user is valid
+func (t *userTable) match(verify func(key string) bool) (config.User, bool) {
+	now := time.Now()
+	for _, u := range t.list() {
+		if u.Key != "" && verify(u.Key) {
+			return u, u.Valid(now)
+		}
+	}
+	return config.User{}, false
+}
+
+// errRevoked is returned by the handshakes of the sessions whose user or device is no longer valid
+var errRevoked = errors.New("disabled, expired or revoked user")
+
+// active reports whether the user of an authenticated session is still valid,
+// its key or the device of its client certificate may have been disabled since
+func (t *userTable) active(user config.User) bool {
+	if _, valid := t.match(func(key string) bool { return key == user.Key }); !valid {
+		return false
+	}
+	u, ok := t.lookup(user.Name)
+	return !ok || u.Valid(time.Now())
+}
+
+// lookup returns the user by name
+func (t *userTable) lookup(name string) (config.User, bool) {
+	for _, u := range t.list() {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return config.User{}, false
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/net-byte/opensocks/config"
+	"github.com/net-byte/opensocks/proto"
+	"github.com/net-byte/opensocks/proxy"
+)
+
+func TestUserTableActive(t *testing.T) {
+	alice := config.User{Name: "alice", Key: "alice-key", Enabled: true}
+	device := config.User{Name: "laptop-01", Key: "alice-key", Enabled: true}
+	tests := []struct {
+		name   string
+		users  []config.User
+		user   config.User
+		active bool
+	}{
+		{"valid", []config.User{alice}, alice, true},
+		{"disabled", []config.User{{Name: "alice", Key: "alice-key"}}, alice, false},
+		{"expired", []config.User{{Name: "alice", Key: "alice-key", Enabled: true, Expiry: time.Now().Add(-time.Hour)}}, alice, false},
+		{"removed", []config.User{{Name: "bob", Key: "bob-key", Enabled: true}}, alice, false},
+		{"key changed", []config.User{{Name: "alice", Key: "new-key", Enabled: true}}, alice, false},
+		{"device", []config.User{alice}, device, true},
+		{"device revoked", []config.User{alice, {Name: "laptop-01"}}, device, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var table userTable
+			table.users.Store(tt.users)
+			if got := table.active(tt.user); got != tt.active {
+				t.Fatalf("got %v, want %v", got, tt.active)
+			}
+		})
+	}
+}
+
+func TestHandshakeRevoked(t *testing.T) {
+	alice := config.User{Name: "alice", Key: "alice-key", Enabled: true}
+	defer _users.users.Store([]config.User(nil))
+	cfg := config.Config{Skew: 60}
+	for _, tt := range []struct {
+		name  string
+		users []config.User
+		err   error
+	}{
+		{"valid", []config.User{alice}, nil},
+		{"disabled after the session opened", []config.User{{Name: "alice", Key: "alice-key"}}, errRevoked},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_users.users.Store(tt.users)
+			req := proxy.RequestAddr{Version: proxy.Version, Network: "tcp", Host: "example.com", Port: 443, Timestamp: time.Now().Unix(), Random: make([]byte, proxy.RandomSize)}
+			rand.Read(req.Random)
+			if err := req.Sign(alice.Key); err != nil {
+				t.Fatal(err)
+			}
+			b, err := req.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, err = proto.Encode(b); err != nil {
+				t.Fatal(err)
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go client.Write(b)
+			_, err = handshake(cfg, alice, server, bufio.NewReader(server))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
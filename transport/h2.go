@@ -0,0 +1,294 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/common/util"
+	"github.com/net-byte/opensocks/config"
+)
+
+func init() {
+	Register("h2", &h2Transport{tls: true})
+	Register("h2c", &h2Transport{})
+}
+
+// The h2 transport struct runs the session over a bidirectional http/2 request, over tls for the h2 protocol
+type h2Transport struct {
+	tls bool
+}
+
+// Check refuses the client certificates on h2c
+func (t *h2Transport) Check(config config.Config) error {
+	return checkClientCA(config, t.tls)
+}
+
+// Dial opens the bidirectional http/2 request to the server
+func (t *h2Transport) Dial(config config.Config) (net.Conn, error) {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	scheme := "http"
+	if t.tls {
+		tlsConfig, err := util.NewClientTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+		transport.Protocols.SetHTTP2(true)
+		scheme = "https"
+	} else {
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, config.ServerAddr, config.H2Path)
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	timer := time.AfterFunc(time.Duration(enum.Timeout)*time.Second, cancel)
+	resp, err := transport.RoundTrip(req)
+	timer.Stop()
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = errors.New(resp.Status)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c := &h2Conn{
+		Reader: resp.Body,
+		Writer: writer,
+		local:  h2Addr("127.0.0.1:0"),
+		remote: h2Addr(config.ServerAddr),
+		done:   make(chan struct{}),
+		close: func() error {
+			writer.Close()
+			cancel()
+			transport.CloseIdleConnections()
+			return resp.Body.Close()
+		},
+	}
+	c.setRead, c.setWrite = c.closeAt(), c.closeAt()
+	log.Printf("[client] %s server connected %s", config.Protocol, url)
+	return c, nil
+}
+
+// Listen serves the http/2 streams on the path, the handler holds each request until its conn is closed
+func (t *h2Transport) Listen(config config.Config, hooks Hooks) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if t.tls {
+		var err error
+		if tlsConfig, err = util.NewServerTLSConfig(config); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("tcp", config.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Protocols: new(http.Protocols), TLSConfig: tlsConfig}
+	listener := newConnListener(l.Addr(), server.Close)
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.H2Path, func(w http.ResponseWriter, r *http.Request) {
+		// serve the requests other than the http/2 streams as the others
+		if r.ProtoMajor != 2 || r.Method != http.MethodPost || hooks.blocked(remoteIP(r.RemoteAddr)) {
+			hooks.serve(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			return
+		}
+		conn := newH2ServerConn(w, r)
+		if !listener.push(conn) {
+			return
+		}
+		<-conn.done
+	})
+	if config.H2Path != "/" {
+		mux.HandleFunc("/", hooks.serve)
+	}
+	server.Handler = mux
+	server.Protocols.SetHTTP1(true)
+	if tlsConfig == nil {
+		server.Protocols.SetUnencryptedHTTP2(true)
+		go func() {
+			server.Serve(l)
+			listener.Close()
+		}()
+		return listener, nil
+	}
+	server.Protocols.SetHTTP2(true)
+	go func() {
+		server.ServeTLS(l, "", "")
+		listener.Close()
+	}()
+	return listener, nil
+}
+
+// The h2 addr type is the address of a http/2 peer
+type h2Addr string
+
+func (a h2Addr) Network() string {
+	return "tcp"
+}
+
+func (a h2Addr) String() string {
+	return string(a)
+}
+
+// The h2 conn struct is a bidirectional http/2 body stream used as a net.Conn
+type h2Conn struct {
+	io.Reader
+	io.Writer
+	local    net.Addr
+	remote   net.Addr
+	state    *tls.ConnectionState
+	done     chan struct{}
+	close    func() error
+	setRead  func(time.Time) error
+	setWrite func(time.Time) error
+	once     sync.Once
+}
+
+// newH2ServerConn creates the conn of the request body and the flushed response of the server
+func newH2ServerConn(w http.ResponseWriter, r *http.Request) *h2Conn {
+	hw := &h2Writer{w: w, rc: http.NewResponseController(w)}
+	return &h2Conn{
+		Reader: r.Body,
+		Writer: hw,
+		local:  h2Addr(r.Host),
+		remote: h2Addr(r.RemoteAddr),
+		state:  r.TLS,
+		done:   make(chan struct{}),
+		close: func() error {
+			hw.close()
+			return r.Body.Close()
+		},
+		setRead:  hw.setReadDeadline,
+		setWrite: hw.setWriteDeadline,
+	}
+}
+
+// The h2 writer struct flushes each write of the response,
+// it refuses the writes and the deadlines once closed as the handler returns then
+type h2Writer struct {
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	lock   sync.Mutex
+	dlock  sync.Mutex
+	closed atomic.Bool
+}
+
+func (w *h2Writer) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := w.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, w.rc.Flush()
+}
+
+func (w *h2Writer) setReadDeadline(t time.Time) error {
+	w.dlock.Lock()
+	defer w.dlock.Unlock()
+	if w.closed.Load() {
+		return net.ErrClosed
+	}
+	return w.rc.SetReadDeadline(t)
+}
+
+func (w *h2Writer) setWriteDeadline(t time.Time) error {
+	w.dlock.Lock()
+	defer w.dlock.Unlock()
+	if w.closed.Load() {
+		return net.ErrClosed
+	}
+	return w.rc.SetWriteDeadline(t)
+}
+
+// close refuses the next writes, it unblocks the running write and waits for it to return
+func (w *h2Writer) close() {
+	w.dlock.Lock()
+	w.closed.Store(true)
+	w.rc.SetWriteDeadline(time.Now())
+	w.dlock.Unlock()
+	w.lock.Lock()
+	w.lock.Unlock()
+}
+
+func (c *h2Conn) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = c.close()
+		close(c.done)
+	})
+	return err
+}
+
+func (c *h2Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *h2Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ConnectionState returns the tls state of the server conn, it is empty for h2c
+func (c *h2Conn) ConnectionState() tls.ConnectionState {
+	if c.state == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.state
+}
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	if err := c.setRead(t); err != nil {
+		return err
+	}
+	return c.setWrite(t)
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	return c.setRead(t)
+}
+
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	return c.setWrite(t)
+}
+
+// closeAt returns a deadline setter closing the conn when the deadline passes
+func (c *h2Conn) closeAt() func(time.Time) error {
+	var lock sync.Mutex
+	var timer *time.Timer
+	return func(t time.Time) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		if !t.IsZero() {
+			timer = time.AfterFunc(time.Until(t), func() { c.Close() })
+		}
+		return nil
+	}
+}
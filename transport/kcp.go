@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/config"
+	"github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func init() {
+	Register("kcp", &kcpTransport{})
+}
+
+// _kcpModes are the nodelay, interval, resend and nc of the kcp mode presets, default is the one of kcp-go
+var _kcpModes = map[string][4]int{
+	"default": {0, 100, 0, 0},
+	"normal":  {0, 40, 2, 1},
+	"fast":    {0, 30, 2, 1},
+	"fast2":   {1, 20, 2, 1},
+	"fast3":   {1, 10, 2, 1},
+}
+
+// The kcp transport struct is the kcp transport with fec over udp
+type kcpTransport struct{}
+
+// Check refuses the client certificates as kcp has no tls
+func (t *kcpTransport) Check(config config.Config) error {
+	return checkClientCA(config, false)
+}
+
+// Dial connects to the kcp server and checks the fec settings of the server match
+func (t *kcpTransport) Dial(config config.Config) (net.Conn, error) {
+	opts, err := newKCPOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	block, err := kcpBlock(config)
+	if err != nil {
+		return nil, err
+	}
+	c, err := kcp.DialWithOptions(config.ServerAddr, block, opts.dataShard, opts.parityShard)
+	if err != nil {
+		return nil, err
+	}
+	opts.apply(c)
+	if err := c.SetDSCP(opts.dscp); err != nil {
+		log.Println("[client] failed to set dscp:", err)
+	}
+	if err := c.SetReadBuffer(enum.SockBuf); err != nil {
+		log.Println("[client] failed to set read buffer:", err)
+	}
+	c.SetDeadline(time.Now().Add(time.Duration(enum.Timeout) * time.Second))
+	defer c.SetDeadline(time.Time{})
+	b := opts.fec()
+	if _, err = c.Write(b); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err = io.ReadFull(c, b); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("no reply from the kcp server, check the key, the crypt, the salt and the fec settings %v", err)
+	}
+	if int(b[0]) != opts.dataShard || int(b[1]) != opts.parityShard {
+		c.Close()
+		return nil, fmt.Errorf("kcp fec %d/%d mismatches %d/%d of the server", opts.dataShard, opts.parityShard, b[0], b[1])
+	}
+	log.Printf("[client] kcp server connected %s", config.ServerAddr)
+	return c, nil
+}
+
+// Listen accepts the kcp sessions with the fec settings of the server
+func (t *kcpTransport) Listen(config config.Config, hooks Hooks) (net.Listener, error) {
+	opts, err := newKCPOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	block, err := kcpBlock(config)
+	if err != nil {
+		return nil, err
+	}
+	l, err := kcp.ListenWithOptions(config.ServerAddr, block, opts.dataShard, opts.parityShard)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.SetDSCP(opts.dscp); err != nil {
+		log.Println("[server] failed to set dscp:", err)
+	}
+	if err := l.SetReadBuffer(enum.SockBuf); err != nil {
+		log.Println("[server] failed to set read buffer:", err)
+	}
+	listener := newConnListener(l.Addr(), l.Close)
+	go func() {
+		defer listener.Close()
+		for {
+			c, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			opts.apply(c)
+			go acceptKCP(c, listener, opts)
+		}
+	}()
+	return listener, nil
+}
+
+// acceptKCP replies the fec settings of the server and pushes the session to the listener if the ones of the client match
+func acceptKCP(c *kcp.UDPSession, listener *connListener, opts kcpOptions) {
+	c.SetDeadline(time.Now().Add(time.Duration(enum.Timeout) * time.Second))
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		c.Close()
+		return
+	}
+	if _, err := c.Write(opts.fec()); err != nil {
+		c.Close()
+		return
+	}
+	if int(b[0]) != opts.dataShard || int(b[1]) != opts.parityShard {
+		log.Printf("[server] kcp fec %d/%d of %v mismatches %d/%d", b[0], b[1], c.RemoteAddr(), opts.dataShard, opts.parityShard)
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	if !listener.push(c) {
+		c.Close()
+	}
+}
+
+// The kcp options struct is the tuning of the kcp sessions
+type kcpOptions struct {
+	noDelay      int
+	interval     int
+	resend       int
+	noCongestion int
+	mtu          int
+	sndWnd       int
+	rcvWnd       int
+	dataShard    int
+	parityShard  int
+	dscp         int
+}
+
+// newKCPOptions returns the options of the config, the mode presets override the manual settings
+func newKCPOptions(config config.Config) (kcpOptions, error) {
+	opts := kcpOptions{
+		noDelay:      config.KCPNoDelay,
+		interval:     config.KCPInterval,
+		resend:       config.KCPResend,
+		noCongestion: config.KCPNoCongestion,
+		mtu:          config.KCPMTU,
+		sndWnd:       config.KCPSndWnd,
+		rcvWnd:       config.KCPRcvWnd,
+		dataShard:    config.KCPDataShard,
+		parityShard:  config.KCPParityShard,
+		dscp:         config.KCPDSCP,
+	}
+	if config.KCPMode != "manual" {
+		mode, ok := _kcpModes[config.KCPMode]
+		if !ok {
+			return opts, fmt.Errorf("unknown kcp mode %q", config.KCPMode)
+		}
+		opts.noDelay, opts.interval, opts.resend, opts.noCongestion = mode[0], mode[1], mode[2], mode[3]
+	}
+	if opts.mtu < 100 || opts.mtu > 1500 {
+		return opts, fmt.Errorf("invalid kcp mtu %d", opts.mtu)
+	}
+	if opts.sndWnd <= 0 || opts.rcvWnd <= 0 {
+		return opts, errors.New("invalid kcp window size")
+	}
+	if opts.dataShard < 0 || opts.parityShard < 0 || opts.dataShard+opts.parityShard > 255 {
+		return opts, fmt.Errorf("invalid kcp fec %d/%d", opts.dataShard, opts.parityShard)
+	}
+	if opts.dscp < 0 || opts.dscp > 63 {
+		return opts, fmt.Errorf("invalid kcp dscp %d", opts.dscp)
+	}
+	return opts, nil
+}
+
+// apply tunes the kcp session
+func (o kcpOptions) apply(c *kcp.UDPSession) {
+	c.SetNoDelay(o.noDelay, o.interval, o.resend, o.noCongestion)
+	c.SetWindowSize(o.sndWnd, o.rcvWnd)
+	c.SetMtu(o.mtu)
+}
+
+// fec returns the fec settings sent to the peer
+func (o kcpOptions) fec() []byte {
+	return []byte{uint8(o.dataShard), uint8(o.parityShard)}
+}
+
+// kcpBlock returns the block crypt of the config with the key derived from the key and the salt, it is nil for none
+func kcpBlock(config config.Config) (kcp.BlockCrypt, error) {
+	key := pbkdf2.Key([]byte(config.Key), []byte(config.KCPSalt), 1024, 32, sha1.New)
+	switch config.KCPCrypt {
+	case "aes":
+		return kcp.NewAESBlockCrypt(key)
+	case "aes-128":
+		return kcp.NewAESBlockCrypt(key[:16])
+	case "aes-192":
+		return kcp.NewAESBlockCrypt(key[:24])
+	case "salsa20":
+		return kcp.NewSalsa20BlockCrypt(key)
+	case "sm4":
+		return kcp.NewSM4BlockCrypt(key[:16])
+	case "xtea":
+		return kcp.NewXTEABlockCrypt(key[:16])
+	case "tea":
+		return kcp.NewTEABlockCrypt(key[:16])
+	case "blowfish":
+		return kcp.NewBlowfishBlockCrypt(key)
+	case "twofish":
+		return kcp.NewTwofishBlockCrypt(key)
+	case "cast5":
+		return kcp.NewCast5BlockCrypt(key[:16])
+	case "3des":
+		return kcp.NewTripleDESBlockCrypt(key[:24])
+	case "xor":
+		return kcp.NewSimpleXORBlockCrypt(key)
+	case "none":
+		// without a block crypt kcp sends the packets without the nonce and the checksum
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown kcp crypt %q", config.KCPCrypt)
+}
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/common/util"
+	"github.com/net-byte/opensocks/config"
+	"github.com/quic-go/quic-go"
+)
+
+func init() {
+	Register("quic", &quicTransport{})
+}
+
+// The quic transport struct maps each stream to a native quic stream
+type quicTransport struct{}
+
+// Dial connects to the quic server and opens the control stream exchanging the session keys
+func (t *quicTransport) Dial(config config.Config) (net.Conn, error) {
+	tlsConfig, err := util.NewClientTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = []string{enum.QUICProto}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(enum.Timeout)*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, config.ServerAddr, tlsConfig, quicConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	log.Printf("[client] quic server connected %s", config.ServerAddr)
+	return &quicConn{quicStream: &quicStream{Stream: stream, conn: conn}}, nil
+}
+
+// Listen accepts the quic connections with their control streams
+func (t *quicTransport) Listen(config config.Config, hooks Hooks) (net.Listener, error) {
+	tlsConfig, err := util.NewServerTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = []string{enum.QUICProto}
+	l, err := quic.ListenAddr(config.ServerAddr, tlsConfig, quicConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	listener := newConnListener(l.Addr(), l.Close)
+	go func() {
+		defer listener.Close()
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go acceptQUIC(conn, listener, hooks)
+		}
+	}()
+	return listener, nil
+}
+
+// acceptQUIC accepts the control stream of the connection and pushes it to the listener
+func acceptQUIC(conn *quic.Conn, listener *connListener, hooks Hooks) {
+	ip := remoteIP(conn.RemoteAddr().String())
+	if hooks.blocked(ip) {
+		conn.CloseWithError(0, "")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(enum.Timeout)*time.Second)
+	stream, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		hooks.failed(ip)
+		conn.CloseWithError(0, "")
+		return
+	}
+	if !listener.push(&quicConn{quicStream: &quicStream{Stream: stream, conn: conn}}) {
+		conn.CloseWithError(0, "")
+	}
+}
+
+// quicConfig returns the quic config of the client and the server with the keepalive of the config
+func quicConfig(config config.Config) *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:     time.Duration(config.KeepAliveTimeout) * time.Second,
+		KeepAlivePeriod:    time.Duration(config.KeepAlive) * time.Second,
+		MaxIncomingStreams: 1 << 16,
+	}
+}
+
+// The quic stream struct is a native quic stream used as a net.Conn
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close closes both directions of the stream
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// The quic conn struct is the control stream of a quic connection, it opens and accepts the other streams natively
+type quicConn struct {
+	*quicStream
+}
+
+func (c *quicConn) OpenStream() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(enum.Timeout)*time.Second)
+	defer cancel()
+	stream, err := c.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: c.conn}, nil
+}
+
+func (c *quicConn) AcceptStream() (net.Conn, error) {
+	stream, err := c.conn.AcceptStream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicStream{Stream: stream, conn: c.conn}, nil
+}
+
+func (c *quicConn) IsClosed() bool {
+	return c.conn.Context().Err() != nil
+}
+
+// Close closes the quic connection with all the streams
+func (c *quicConn) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
+
+// ConnectionState returns the tls state of the quic connection
+func (c *quicConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
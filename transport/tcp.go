@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/common/util"
+	"github.com/net-byte/opensocks/config"
+)
+
+func init() {
+	Register("tcp", &tcpTransport{})
+	Register("tls", &tcpTransport{tls: true})
+}
+
+// The tcp transport struct is the raw tcp transport, over tls for the tls protocol
+type tcpTransport struct {
+	tls bool
+}
+
+// Fallback returns true as the bytes read from the conns are the ones the client sent
+func (t *tcpTransport) Fallback() bool {
+	return true
+}
+
+// Check refuses the client certificates without tls
+func (t *tcpTransport) Check(config config.Config) error {
+	return checkClientCA(config, t.tls)
+}
+
+func (t *tcpTransport) Dial(config config.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Duration(enum.Timeout) * time.Second}
+	if !t.tls {
+		c, err := dialer.Dial("tcp", config.ServerAddr)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[client] tcp server connected %s", config.ServerAddr)
+		return c, nil
+	}
+	tlsConfig, err := util.NewClientTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	c, err := tls.DialWithDialer(dialer, "tcp", config.ServerAddr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[client] tls server connected %s", config.ServerAddr)
+	return c, nil
+}
+
+func (t *tcpTransport) Listen(config config.Config, hooks Hooks) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if t.tls {
+		var err error
+		if tlsConfig, err = util.NewServerTLSConfig(config); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("tcp", config.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, nil
+}
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/net-byte/opensocks/config"
+)
+
+// The Transport interface dials and listens the connections of a protocol
+type Transport interface {
+	// Dial connects to the server address
+	Dial(config config.Config) (net.Conn, error)
+	// Listen listens on the server address with the hooks of the server
+	Listen(config config.Config, hooks Hooks) (net.Listener, error)
+}
+
+// The Muxer interface is implemented by the conns of the transports multiplexing the streams natively
+type Muxer interface {
+	net.Conn
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	IsClosed() bool
+}
+
+// The Checker interface is implemented by the transports refusing some settings of the config
+type Checker interface {
+	Check(config config.Config) error
+}
+
+// The Fallback interface is implemented by the transports carrying the raw bytes of the client,
+// the conns failing the handshake are spliced to the fallback address if it returns true
+type Fallback interface {
+	Fallback() bool
+}
+
+// The Hooks struct is the server callbacks of the transports handshaking before the conns are accepted
+type Hooks struct {
+	// Blocked reports whether the ip is dropped before the handshake
+	Blocked func(ip string) bool
+	// Failed reports the ip failing the handshake of the transport
+	Failed func(ip string)
+	// Handler serves the http requests other than the tunnels
+	Handler http.Handler
+}
+
+func (h Hooks) blocked(ip string) bool {
+	return h.Blocked != nil && h.Blocked(ip)
+}
+
+func (h Hooks) failed(ip string) {
+	if h.Failed != nil {
+		h.Failed(ip)
+	}
+}
+
+func (h Hooks) serve(w http.ResponseWriter, r *http.Request) {
+	if h.Handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+var _transports = make(map[string]Transport)
+
+// Register registers the transport of the protocol, it is called by the init of the transports
+func Register(protocol string, transport Transport) {
+	_transports[protocol] = transport
+}
+
+// Get returns the transport of the protocol
+func Get(protocol string) (Transport, error) {
+	transport, ok := _transports[protocol]
+	if !ok {
+		return nil, fmt.Errorf("unsupported protocol %q", protocol)
+	}
+	return transport, nil
+}
+
+// Check returns the error of the settings of the config refused by the transport of the protocol
+func Check(config config.Config) error {
+	t, err := Get(config.Protocol)
+	if err != nil {
+		return err
+	}
+	if c, ok := t.(Checker); ok {
+		return c.Check(config)
+	}
+	return nil
+}
+
+// checkClientCA refuses the client certificates on a server listener not terminating tls as they would not be checked
+func checkClientCA(config config.Config, tls bool) error {
+	if config.ServerMode && config.TLSClientCA != "" && !tls {
+		return fmt.Errorf("-tls-client-ca needs a listener terminating tls, %s does not", config.Protocol)
+	}
+	return nil
+}
+
+// The conn listener struct accepts the conns pushed by the goroutines serving a transport
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	close func() error
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr, close func() error) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{}), close: close}
+}
+
+// push hands the conn to Accept, it returns false if the listener is closed
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		close(l.done)
+		err = l.close()
+	})
+	return err
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// remoteIP returns the ip of the remote address
+func remoteIP(addr string) string {
+	if ip, _, err := net.SplitHostPort(addr); err == nil {
+		return ip
+	}
+	return addr
+}
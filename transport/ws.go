@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/net-byte/opensocks/common/enum"
+	"github.com/net-byte/opensocks/common/util"
+	"github.com/net-byte/opensocks/config"
+)
+
+func init() {
+	Register("ws", &wsTransport{})
+	Register("wss", &wsTransport{tls: true})
+}
+
+// The ws transport struct is the websocket transport, over tls for the wss protocol
+type wsTransport struct {
+	tls bool
+}
+
+// Check refuses the client certificates unless wss is served with a certificate
+func (t *wsTransport) Check(config config.Config) error {
+	if t.tls && !config.ServerTLS() && config.ServerMode && config.TLSClientCA != "" {
+		return errors.New("-tls-client-ca needs a server certificate to serve wss over tls")
+	}
+	return checkClientCA(config, t.tls)
+}
+
+func (t *wsTransport) Dial(config config.Config) (net.Conn, error) {
+	scheme := "ws"
+	if t.tls {
+		scheme = "wss"
+	}
+	host := config.ServerAddr
+	if config.WSHost != "" {
+		host = config.WSHost
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, host, config.WSPath)
+	dialer := &ws.Dialer{ReadBufferSize: enum.BufferSize, WriteBufferSize: enum.BufferSize, Timeout: time.Duration(enum.Timeout) * time.Second}
+	if header := config.WSRequestHeader(); len(header) > 0 {
+		dialer.Header = ws.HandshakeHeaderHTTP(header)
+	}
+	// dial the connect address or the server address whatever the host header is
+	connectAddr := config.ServerAddr
+	if config.WSConnect != "" {
+		connectAddr = config.WSConnect
+	}
+	dialer.NetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := &net.Dialer{Timeout: time.Duration(enum.Timeout) * time.Second}
+		return d.DialContext(ctx, network, connectAddr)
+	}
+	if t.tls {
+		tlsConfig, err := util.NewClientTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		dialer.TLSConfig = tlsConfig
+	}
+	c, _, _, err := dialer.Dial(context.Background(), url)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[client] ws server connected %s", url)
+	return c, nil
+}
+
+// Listen serves the websocket upgrades on the path, tls is served only if the server has a certificate
+func (t *wsTransport) Listen(config config.Config, hooks Hooks) (net.Listener, error) {
+	l, err := net.Listen("tcp", config.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{}
+	listener := newConnListener(l.Addr(), server.Close)
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.WSPath, func(w http.ResponseWriter, r *http.Request) {
+		// drop the repeated probes silently
+		if hooks.blocked(remoteIP(r.RemoteAddr)) {
+			if hijacker, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+				}
+			}
+			return
+		}
+		// serve the requests without the secret as the others
+		if config.WSSecret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+config.WSSecret)) != 1 {
+			hooks.serve(w, r)
+			return
+		}
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			log.Printf("[server] failed to upgrade http %v", err)
+			return
+		}
+		if !listener.push(conn) {
+			conn.Close()
+		}
+	})
+	if config.WSPath != "/" {
+		mux.HandleFunc("/", hooks.serve)
+	}
+	server.Handler = mux
+	if t.tls && config.ServerTLS() {
+		if server.TLSConfig, err = util.NewServerTLSConfig(config); err != nil {
+			l.Close()
+			return nil, err
+		}
+		go func() {
+			server.ServeTLS(l, "", "")
+			listener.Close()
+		}()
+		return listener, nil
+	}
+	go func() {
+		server.Serve(l)
+		listener.Close()
+	}()
+	return listener, nil
+}